@@ -20,9 +20,9 @@ import (
 )
 
 type Client struct {
-	config *Config
-	client *libclient.Client
-	osType OSType
+	config  *Config
+	clients map[string]*libclient.Client
+	osType  OSType
 }
 
 func New(config *Config) (*Client, error) {
@@ -33,14 +33,14 @@ func New(config *Config) (*Client, error) {
 
 	config = config.Clone()
 
-	if config.Secret == "" {
-		return nil, fmt.Errorf("secret is required")
-	}
-
 	if config.Server == "" {
 		return nil, fmt.Errorf("server is required")
 	}
 
+	if config.ClientCert != "" && config.ClientKey == "" {
+		return nil, fmt.Errorf("clientKey is required with clientCert")
+	}
+
 	processDomain := func(domain *Domain) error {
 
 		if domain.Name == "" {
@@ -59,6 +59,23 @@ func New(config *Config) (*Client, error) {
 			return fmt.Errorf("domain %s: KeyFile is required", domain.Name)
 		}
 
+		if domain.KeyAlgorithm == KeyAlgorithmBoth {
+
+			if domain.ECDSACertFile == "" && domain.ECDSAFullChain == "" {
+				return fmt.Errorf("domain %s: one or both of the following is required when KeyAlgorithm is %s: ECDSACertFile, ECDSAFullChain", domain.Name, KeyAlgorithmBoth)
+			}
+
+			if domain.ECDSAKeyFile == "" {
+				return fmt.Errorf("domain %s: ECDSAKeyFile is required when KeyAlgorithm is %s", domain.Name, KeyAlgorithmBoth)
+			}
+
+			return nil
+		}
+
+		if types.KeyAlgorithmFromString(domain.KeyAlgorithm) == types.KeyAlgorithmUnknown {
+			return fmt.Errorf("domain %s: KeyAlgorithm %s is not supported", domain.Name, domain.KeyAlgorithm)
+		}
+
 		return nil
 	}
 
@@ -247,14 +264,41 @@ func New(config *Config) (*Client, error) {
 		}
 	}
 
+	// A domain with a secret uses its own secret and the other domains use the
+	// global secret. There is one libclient for each secret
+	clients := make(map[string]*libclient.Client)
+
+	for _, domain := range config.Domains {
+
+		secret := domain.getSecret(config)
+
+		if secret == "" && config.ClientCert == "" {
+			return nil, fmt.Errorf("domain %s: secret or clientCert is required", domain.Name)
+		}
+
+		if clients[secret] == nil {
+
+			// The identity only applies to the global secret
+			identity := ""
+			if secret == config.Secret {
+				identity = config.Identity
+			}
+
+			clients[secret] = libclient.New(&libclient.Config{
+				Identity:   identity,
+				Secret:     secret,
+				ClientCert: config.ClientCert,
+				ClientKey:  config.ClientKey,
+				Server:     config.Server,
+				SkipVerify: config.SkipVerify,
+			})
+		}
+	}
+
 	return &Client{
-		osType: osType,
-		config: config,
-		client: libclient.New(&libclient.Config{
-			Secret:     config.Secret,
-			Server:     config.Server,
-			SkipVerify: config.SkipVerify,
-		}),
+		osType:  osType,
+		config:  config,
+		clients: clients,
 	}, nil
 }
 
@@ -310,33 +354,35 @@ func (t *Client) Run(ctx context.Context) error {
 		return nil
 	}
 
-	process := func(domain *Domain, cert *CR) error {
+	install := func(domain *Domain, keyFile, certFile, fullChain, ocspFile string, response *CertResponse) (bool, error) {
+
+		cert := response.CR
 
 		result := false
 
-		if domain.KeyFile != "" {
+		if keyFile != "" {
 
 			if logger.Trace {
-				zap.L().Debug(fmt.Sprintf("Domain %s: has KeyFile %s", domain.Name, domain.KeyFile))
+				zap.L().Debug(fmt.Sprintf("Domain %s: has KeyFile %s", domain.Name, keyFile))
 			}
 
 			data := cert.GetKeyPEM()
 
-			if !compare(domain.KeyFile, data) {
+			if !compare(keyFile, data) {
 
 				result = true
 				if logger.Trace {
-					zap.L().Debug(fmt.Sprintf("Domain %s: KeyFile %s changed", domain.Name, domain.KeyFile))
+					zap.L().Debug(fmt.Sprintf("Domain %s: KeyFile %s changed", domain.Name, keyFile))
 				}
 
-				err := writeFile(domain.KeyFile, data)
+				err := writeFile(keyFile, data)
 				if err != nil {
-					return err
+					return false, err
 				}
 
 			} else {
 				if logger.Trace {
-					zap.L().Debug(fmt.Sprintf("Domain %s: KeyFile %s unchanged", domain.Name, domain.KeyFile))
+					zap.L().Debug(fmt.Sprintf("Domain %s: KeyFile %s unchanged", domain.Name, keyFile))
 				}
 			}
 		} else {
@@ -345,29 +391,29 @@ func (t *Client) Run(ctx context.Context) error {
 			}
 		}
 
-		if domain.CertFile != "" {
+		if certFile != "" {
 
 			if logger.Trace {
-				zap.L().Debug(fmt.Sprintf("Domain %s: has CertFile %s", domain.Name, domain.CertFile))
+				zap.L().Debug(fmt.Sprintf("Domain %s: has CertFile %s", domain.Name, certFile))
 			}
 
 			data := cert.GetCertPEM()
 
-			if !compare(domain.CertFile, data) {
+			if !compare(certFile, data) {
 
 				result = true
 				if logger.Trace {
-					zap.L().Debug(fmt.Sprintf("Domain %s: CertFile %s changed", domain.Name, domain.CertFile))
+					zap.L().Debug(fmt.Sprintf("Domain %s: CertFile %s changed", domain.Name, certFile))
 				}
 
-				err := writeFile(domain.CertFile, data)
+				err := writeFile(certFile, data)
 				if err != nil {
-					return err
+					return false, err
 				}
 
 			} else {
 				if logger.Trace {
-					zap.L().Debug(fmt.Sprintf("Domain %s: CertFile %s unchanged", domain.Name, domain.CertFile))
+					zap.L().Debug(fmt.Sprintf("Domain %s: CertFile %s unchanged", domain.Name, certFile))
 				}
 			}
 		} else {
@@ -376,29 +422,29 @@ func (t *Client) Run(ctx context.Context) error {
 			}
 		}
 
-		if domain.FullChain != "" {
+		if fullChain != "" {
 
 			if logger.Trace {
-				zap.L().Debug(fmt.Sprintf("Domain %s: has CertFile %s", domain.Name, domain.FullChain))
+				zap.L().Debug(fmt.Sprintf("Domain %s: has CertFile %s", domain.Name, fullChain))
 			}
 
 			data := cert.GetCertPEM()
 
-			if !compare(domain.FullChain, data) {
+			if !compare(fullChain, data) {
 
 				result = true
 				if logger.Trace {
-					zap.L().Debug(fmt.Sprintf("Domain %s: FullChain %s changed", domain.Name, domain.FullChain))
+					zap.L().Debug(fmt.Sprintf("Domain %s: FullChain %s changed", domain.Name, fullChain))
 				}
 
-				err := writeFile(domain.FullChain, data)
+				err := writeFile(fullChain, data)
 				if err != nil {
-					return err
+					return false, err
 				}
 
 			} else {
 				if logger.Trace {
-					zap.L().Debug(fmt.Sprintf("Domain %s: FullChain %s unchanged", domain.Name, domain.FullChain))
+					zap.L().Debug(fmt.Sprintf("Domain %s: FullChain %s unchanged", domain.Name, fullChain))
 				}
 			}
 		} else {
@@ -407,6 +453,53 @@ func (t *Client) Run(ctx context.Context) error {
 			}
 		}
 
+		if ocspFile != "" && len(response.OCSP) > 0 {
+
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Domain %s: has OCSPFile %s", domain.Name, ocspFile))
+			}
+
+			if !compare(ocspFile, response.OCSP) {
+
+				result = true
+				if logger.Trace {
+					zap.L().Debug(fmt.Sprintf("Domain %s: OCSPFile %s changed", domain.Name, ocspFile))
+				}
+
+				err := writeFile(ocspFile, response.OCSP)
+				if err != nil {
+					return false, err
+				}
+
+			} else {
+				if logger.Trace {
+					zap.L().Debug(fmt.Sprintf("Domain %s: OCSPFile %s unchanged", domain.Name, ocspFile))
+				}
+			}
+		} else if ocspFile != "" {
+			zap.L().Debug(fmt.Sprintf("Domain %s: server does not have an OCSP response", domain.Name))
+		}
+
+		return result, nil
+	}
+
+	process := func(domain *Domain, cert, ecdsaCert *CertResponse) error {
+
+		result, err := install(domain, domain.KeyFile, domain.CertFile, domain.FullChain, domain.OCSPFile, cert)
+		if err != nil {
+			return err
+		}
+
+		if ecdsaCert != nil {
+
+			changed, err := install(domain, domain.ECDSAKeyFile, domain.ECDSACertFile, domain.ECDSAFullChain, domain.ECDSAOCSPFile, ecdsaCert)
+			if err != nil {
+				return err
+			}
+
+			result = result || changed
+		}
+
 		if result {
 
 			if domain.Hook == nil {
@@ -424,6 +517,29 @@ func (t *Client) Run(ctx context.Context) error {
 		return nil
 	}
 
+	// lifetimes is the last known lifetime of each domain certificate. It is
+	// kept when a fetch fails so a failed run does not lengthen the refresh
+	// interval for short lived certificates
+	lifetimes := make(map[string]time.Duration)
+
+	getCert := func(domain *Domain, keyAlgorithm KeyAlgorithm) (*CertResponse, error) {
+
+		result, err := t.clients[domain.getSecret(t.config)].GetCertResponse(domain.DomainName, keyAlgorithm, domain.Chain)
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Degraded {
+			zap.L().Warn(fmt.Sprintf("Domain %s: server certificate is degraded; %s", domain.Name, result.DegradedReason))
+		}
+
+		if l := result.GetLifetime(); l > 0 {
+			lifetimes[domain.Name+"/"+string(keyAlgorithm)] = l
+		}
+
+		return result, nil
+	}
+
 	run := func() error {
 
 		zap.L().Debug("Processing domains")
@@ -432,13 +548,33 @@ func (t *Client) Run(ctx context.Context) error {
 
 		for _, domain := range t.config.Domains {
 
-			cert, err := t.client.GetCert(domain.DomainName)
-			if err != nil {
-				errs = multierror.Append(errs, fmt.Errorf("Domain %s %w", domain.Name, err))
-				continue
+			var cert, ecdsaCert *CertResponse
+			var err error
+
+			if domain.KeyAlgorithm == KeyAlgorithmBoth {
+
+				cert, err = getCert(domain, types.KeyAlgorithmRSA)
+				if err != nil {
+					errs = multierror.Append(errs, fmt.Errorf("Domain %s %w", domain.Name, err))
+					continue
+				}
+
+				ecdsaCert, err = getCert(domain, types.KeyAlgorithmECDSA)
+				if err != nil {
+					errs = multierror.Append(errs, fmt.Errorf("Domain %s %w", domain.Name, err))
+					continue
+				}
+
+			} else {
+
+				cert, err = getCert(domain, types.KeyAlgorithmFromString(domain.KeyAlgorithm))
+				if err != nil {
+					errs = multierror.Append(errs, fmt.Errorf("Domain %s %w", domain.Name, err))
+					continue
+				}
 			}
 
-			err = process(domain, cert)
+			err = process(domain, cert, ecdsaCert)
 			if err != nil {
 				errs = multierror.Append(errs, fmt.Errorf("Domain %s %w", domain.Name, err))
 				continue
@@ -458,11 +594,16 @@ func (t *Client) Run(ctx context.Context) error {
 		}
 	}
 
-	runDaemon := func() {
-
-		zap.L().Debug("Running as daemon")
+	// getRefreshInterval returns the configured refresh interval shortened to
+	// LifetimeRefreshRatio of the shortest certificate lifetime
+	getRefreshInterval := func() time.Duration {
 
-		run()
+		var lifetime time.Duration
+		for _, l := range lifetimes {
+			if lifetime == 0 || l < lifetime {
+				lifetime = l
+			}
+		}
 
 		refreshInterval := t.config.RefreshInterval
 
@@ -473,20 +614,41 @@ func (t *Client) Run(ctx context.Context) error {
 			zap.L().Debug(fmt.Sprintf("Refresh Interval is %s (default)", refreshInterval.String()))
 		}
 
-		ticker := time.NewTicker(refreshInterval)
-		defer ticker.Stop()
+		if lifetime <= 0 {
+			return refreshInterval
+		}
+
+		lifetimeInterval := time.Duration(float64(lifetime) * LifetimeRefreshRatio)
+		if lifetimeInterval < MinRefreshInterval {
+			lifetimeInterval = MinRefreshInterval
+		}
+
+		if lifetimeInterval < refreshInterval {
+			refreshInterval = lifetimeInterval
+			zap.L().Debug(fmt.Sprintf("Refresh Interval is %s (certificate lifetime %s)", refreshInterval.String(), lifetime.String()))
+		}
+
+		return refreshInterval
+	}
+
+	runDaemon := func() {
+
+		zap.L().Debug("Running as daemon")
 
 		for {
 
+			timer := time.NewTimer(getRefreshInterval())
+
 			select {
 
 			case <-ctx.Done():
+				timer.Stop()
 				zap.L().Debug("Shutting down on context")
 				return
 
-			case <-ticker.C:
+			case <-timer.C:
 				zap.L().Debug("Tick")
-				return
+				runTick()
 
 			}
 
@@ -497,7 +659,9 @@ func (t *Client) Run(ctx context.Context) error {
 	zap.L().Debug("Client is now running")
 
 	defer func() {
-		t.client.Shutdown()
+		for _, client := range t.clients {
+			client.Shutdown()
+		}
 		zap.L().Debug("Client is shutting down")
 	}()
 
@@ -7,8 +7,12 @@ const (
 	DetectUnifiFile    = "/sys/fs/cgroup/system.slice/unifi.service/cgroup.type"
 
 	DefaultRefreshInterval = time.Hour * 24
+	MinRefreshInterval     = time.Minute * 5
+	LifetimeRefreshRatio   = 1.0 / 6
 
-	ConfigNotes = "RefreshInterval is optional. It is only used if daemon is set to true. If the system type is Synology only the domain Name is required (not CertFile, KeyFile, KeyStore or Hook)"
+	ConfigNotes = "RefreshInterval is optional. It is only used if daemon is set to true. If the system type is Synology only the domain Name is required (not CertFile, KeyFile, KeyStore or Hook). See the README for the other settings"
+
+	KeyAlgorithmBoth = "both"
 
 	UnifiCertFile = "/data/unifi-core/config/unifi-core.crt"
 	UnifiKeyFile  = "/data/unifi-core/config/unifi-core.key"
@@ -22,14 +22,18 @@ func ExampleConfig() *Config {
 		DomainName: "example1.com",
 		CertFile:   "/path/to/certfile1.pem",
 		KeyFile:    "/path/to/keyfile1.pem",
+		OCSPFile:   "/path/to/certfile1.ocsp",
 		Hook:       refreshedHook,
 	}
 
 	domain2 := &Domain{
-		Name:       "example2",
-		DomainName: "example2.com",
-		CertFile:   "/path/to/certfile2.pem",
-		KeyFile:    "/path/to/keyfile2.pem",
+		Name:          "example2",
+		DomainName:    "example2.com",
+		KeyAlgorithm:  KeyAlgorithmBoth,
+		CertFile:      "/path/to/certfile2.pem",
+		KeyFile:       "/path/to/keyfile2.pem",
+		ECDSACertFile: "/path/to/certfile2-ecdsa.pem",
+		ECDSAKeyFile:  "/path/to/keyfile2-ecdsa.pem",
 	}
 
 	c.AddDomain(domain1, domain2)
@@ -10,11 +10,17 @@ import (
 )
 
 type CR = types.CR
+type CertResponse = types.CertResponse
+type KeyAlgorithm = types.KeyAlgorithm
 type Logger = logger.Config
 
 type Config struct {
 	Notes           string        `json:"notes,omitempty" yaml:"notes,omitempty"`
+	Identity        string        `json:"identity,omitempty" yaml:"identity,omitempty"`
 	Secret          string        `json:"secret" yaml:"secret"`
+	AdminSecret     string        `json:"adminSecret,omitempty" yaml:"adminSecret,omitempty"`
+	ClientCert      string        `json:"clientCert,omitempty" yaml:"clientCert,omitempty"`
+	ClientKey       string        `json:"clientKey,omitempty" yaml:"clientKey,omitempty"`
 	Server          string        `json:"server" yaml:"server"`
 	SkipVerify      bool          `json:"skipVerify" yaml:"skipVerify"`
 	Domains         []*Domain     `json:"domains,omitempty" yaml:"domains,omitempty"`
@@ -37,12 +43,20 @@ func (t *Config) AddDomain(domains ...*Domain) *Config {
 }
 
 type Domain struct {
-	Name       string `json:"name,omitempty" yaml:"name,omitempty"`
-	DomainName string `json:"domainName,omitempty" yaml:"domainName,omitempty"`
-	KeyFile    string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
-	CertFile   string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
-	FullChain  string `json:"fullChain,omitempty" yaml:"fullChain,omitempty"`
-	Hook       *Hook  `json:"hook,omitempty" yaml:"hook,omitempty"`
+	Name           string `json:"name,omitempty" yaml:"name,omitempty"`
+	DomainName     string `json:"domainName,omitempty" yaml:"domainName,omitempty"`
+	Secret         string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	KeyAlgorithm   string `json:"keyAlgorithm,omitempty" yaml:"keyAlgorithm,omitempty"`
+	Chain          string `json:"chain,omitempty" yaml:"chain,omitempty"`
+	KeyFile        string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	CertFile       string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	FullChain      string `json:"fullChain,omitempty" yaml:"fullChain,omitempty"`
+	OCSPFile       string `json:"ocspFile,omitempty" yaml:"ocspFile,omitempty"`
+	ECDSAKeyFile   string `json:"ecdsaKeyFile,omitempty" yaml:"ecdsaKeyFile,omitempty"`
+	ECDSACertFile  string `json:"ecdsaCertFile,omitempty" yaml:"ecdsaCertFile,omitempty"`
+	ECDSAFullChain string `json:"ecdsaFullChain,omitempty" yaml:"ecdsaFullChain,omitempty"`
+	ECDSAOCSPFile  string `json:"ecdsaOcspFile,omitempty" yaml:"ecdsaOcspFile,omitempty"`
+	Hook           *Hook  `json:"hook,omitempty" yaml:"hook,omitempty"`
 }
 
 // Clone return copy
@@ -52,6 +66,14 @@ func (t *Domain) Clone() *Domain {
 	return c
 }
 
+// getSecret returns the domain secret or the global secret if it is not set
+func (t *Domain) getSecret(config *Config) string {
+	if t.Secret != "" {
+		return t.Secret
+	}
+	return config.Secret
+}
+
 type Hook struct {
 	Name string   `json:"name" yaml:"name"`
 	Args []string `json:"args,omitempty" yaml:"args,omitempty"`
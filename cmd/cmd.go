@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"os"
 	"os/signal"
@@ -10,6 +12,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/hokaccha/go-prettyjson"
@@ -19,6 +22,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/jodydadescott/home-simplecert/client"
+	"github.com/jodydadescott/home-simplecert/libclient"
 	"github.com/jodydadescott/home-simplecert/server"
 	"github.com/jodydadescott/home-simplecert/types"
 	"github.com/jodydadescott/home-simplecert/util"
@@ -82,9 +86,179 @@ func getExampleConfigCmd() *cobra.Command {
 	return cmd
 }
 
+// getConfigFile returns the file set by the config flag, the config env var or
+// the default config file in that order
+func getConfigFile() string {
+
+	configFile := configFileArg
+
+	if configFile == "" {
+		configFile = os.Getenv(ConfigEnvVar)
+	}
+
+	if configFile == "" {
+		configFile = DefaultConfigFile
+	}
+
+	return configFile
+}
+
+// getConfig returns the config from the config file
+func getConfig() (*Config, error) {
+
+	configFile := getConfigFile()
+
+	if !util.FileExist(configFile) {
+		return nil, fmt.Errorf("config file %s does not exist", configFile)
+	}
+
+	fileStats, err := os.Stat(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := fileStats.Mode().Perm()
+	if permissions != types.SecureFilePerm {
+		return nil, fmt.Errorf("config file %s has overly promiscuous permissions", configFile)
+	}
+
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	err = json.Unmarshal(content, &config)
+	if err == nil {
+		return &config, nil
+	}
+
+	var errs *multierror.Error
+
+	errs = multierror.Append(errs, err)
+
+	err = yaml.Unmarshal(content, &config)
+	if err == nil {
+		return &config, nil
+	}
+
+	errs = multierror.Append(errs, err)
+
+	return nil, errs.ErrorOrNil()
+}
+
+// getAdminLibClient returns a libclient for the admin commands. The admin
+// secret in the client config is used if it is set, otherwise the client must
+// be an admin identity. The global secret is not valid for the admin requests
+// so it is never used
+func getAdminLibClient() (*libclient.Client, error) {
+
+	config, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Client == nil {
+		return nil, fmt.Errorf("config does not have a client config")
+	}
+
+	if config.Client.Server == "" {
+		return nil, fmt.Errorf("client server is required")
+	}
+
+	if config.Client.AdminSecret != "" {
+		return libclient.New(&libclient.Config{
+			Secret:     config.Client.AdminSecret,
+			Server:     config.Client.Server,
+			SkipVerify: config.Client.SkipVerify,
+		}), nil
+	}
+
+	if config.Client.Identity == "" && config.Client.ClientCert == "" {
+		return nil, fmt.Errorf("client adminSecret, or identity or client cert of an admin identity, is required")
+	}
+
+	if config.Client.ClientCert != "" && config.Client.ClientKey == "" {
+		return nil, fmt.Errorf("client key is required with client cert")
+	}
+
+	// Without an identity the secret would be checked as the global secret
+	secret := ""
+	if config.Client.Identity != "" {
+		secret = config.Client.Secret
+	}
+
+	if secret == "" && config.Client.ClientCert == "" {
+		return nil, fmt.Errorf("client secret of identity %s is required", config.Client.Identity)
+	}
+
+	return libclient.New(&libclient.Config{
+		Identity:   config.Client.Identity,
+		Secret:     secret,
+		ClientCert: config.Client.ClientCert,
+		ClientKey:  config.Client.ClientKey,
+		Server:     config.Client.Server,
+		SkipVerify: config.Client.SkipVerify,
+	}), nil
+}
+
+// saveConfig writes the config to the config file. The config is written as
+// JSON if the existing file is JSON and otherwise as YAML
+func saveConfig(config *Config) error {
+
+	configFile := getConfigFile()
+
+	writeJSON := false
+	if content, err := os.ReadFile(configFile); err == nil {
+		writeJSON = json.Valid(content)
+	}
+
+	var b []byte
+	var err error
+
+	if writeJSON {
+		b, err = json.MarshalIndent(config, "", "  ")
+	} else {
+		b, err = yaml.Marshal(config)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(configFile, b, types.SecureFilePerm)
+	if err != nil {
+		return err
+	}
+
+	// WriteFile does not change the permissions of an existing file
+	return os.Chmod(configFile, types.SecureFilePerm)
+}
+
+func printJSON(o any) error {
+	b, err := prettyjson.Marshal(o)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
 var (
-	configFileArg string
-	debugLevelArg string
+	configFileArg   string
+	debugLevelArg   string
+	keyAlgorithmArg string
+	reasonArg       string
+	emailArgs       []string
+	domainArgs      []string
+	adminArg        bool
+	expiresArg      time.Duration
+	subjectArg      string
+	spkiArg         string
+	nameArg         string
+	lifeArg         time.Duration
+	serverArg       string
+	skipVerifyArg   bool
 
 	rootCmd = &cobra.Command{
 		Use: BinaryName,
@@ -203,53 +377,438 @@ var (
 		},
 	}
 
-	runCmd = &cobra.Command{
+	statusCmd = &cobra.Command{
+		Use:  "status",
+		Long: "Returns the status of the server domains using the client config",
+		RunE: func(cmd *cobra.Command, args []string) error {
 
-		Use: "run",
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
 
+			defer client.Shutdown()
+
+			status, err := client.GetStatus()
+			if err != nil {
+				return err
+			}
+
+			return printJSON(status)
+		},
+	}
+
+	revokeCmd = &cobra.Command{
+		Use:  "revoke domain",
+		Long: "Revokes the certificate of the domain using the client config. The server reissues it in the background and the status command reports the new serial. The reason is one of unspecified, keyCompromise, affiliationChanged, superseded or cessationOfOperation, or its reason code",
+		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 
-			getConfig := func(configFile string) (*Config, error) {
+			keyAlgorithm := types.KeyAlgorithmFromString(keyAlgorithmArg)
+			if keyAlgorithm == types.KeyAlgorithmUnknown {
+				return fmt.Errorf("key algorithm %s is not supported", keyAlgorithmArg)
+			}
 
-				if !util.FileExist(configFile) {
-					return nil, fmt.Errorf("config file %s does not exist", configFile)
-				}
+			reason := types.RevocationReasonFromString(reasonArg)
+			if reason == types.RevocationReasonUnknown {
+				return fmt.Errorf("reason %s is not supported", reasonArg)
+			}
 
-				fileStats, err := os.Stat(configFile)
-				if err != nil {
-					return nil, err
-				}
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			response, err := client.Revoke(args[0], keyAlgorithm, reason)
+			if response != nil {
+				printJSON(response)
+			}
+
+			return err
+		},
+	}
+
+	rateLimitsCmd = &cobra.Command{
+		Use:  "ratelimits",
+		Long: "Returns the remaining headroom of the CA rate limits for the server domains using the client config",
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			rateLimits, err := client.GetRateLimits()
+			if err != nil {
+				return err
+			}
+
+			return printJSON(rateLimits)
+		},
+	}
+
+	accountCmd = &cobra.Command{
+		Use:  "account",
+		Long: "Manages the ACME accounts of the server domains using the client config",
+	}
+
+	accountListCmd = &cobra.Command{
+		Use:  "list",
+		Long: "Returns the ACME account of each domain",
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			accounts, err := client.GetAccounts()
+			if err != nil {
+				return err
+			}
 
-				permissions := fileStats.Mode().Perm()
-				if permissions != types.SecureFilePerm {
-					return nil, fmt.Errorf("config file %s has overly promiscuous permissions", configFile)
+			return printJSON(accounts)
+		},
+	}
+
+	accountURLCmd = &cobra.Command{
+		Use:  "url domain",
+		Long: "Returns the ACME account URL of the domain",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			accounts, err := client.GetAccounts()
+			if err != nil {
+				return err
+			}
+
+			for _, account := range accounts.Accounts {
+				if account.Domain == args[0] {
+					if account.URL == "" {
+						return fmt.Errorf("domain %s account is not registered", args[0])
+					}
+					fmt.Println(account.URL)
+					return nil
 				}
+			}
+
+			return fmt.Errorf("domain %s does not have an account", args[0])
+		},
+	}
+
+	accountRotateKeyCmd = &cobra.Command{
+		Use:  "rotate-key domain",
+		Long: "Replaces the ACME account key of the domain using key change",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			account, err := client.RotateAccountKey(args[0])
+			if err != nil {
+				return err
+			}
+
+			return printJSON(account)
+		},
+	}
+
+	accountUpdateCmd = &cobra.Command{
+		Use:  "update domain",
+		Long: "Replaces the ACME account contacts of the domain with the emails",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if len(emailArgs) == 0 {
+				return fmt.Errorf("at least one email is required")
+			}
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			account, err := client.UpdateAccountContacts(args[0], emailArgs)
+			if err != nil {
+				return err
+			}
+
+			return printJSON(account)
+		},
+	}
+
+	accountDeactivateCmd = &cobra.Command{
+		Use:  "deactivate domain",
+		Long: "Deactivates the ACME account of the domain. A new account is registered on the next renewal",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			account, err := client.DeactivateAccount(args[0])
+			if err != nil {
+				return err
+			}
+
+			return printJSON(account)
+		},
+	}
+
+	identityCmd = &cobra.Command{
+		Use:  "identity",
+		Long: "Manages the client identities of the server using the client config",
+	}
+
+	identityListCmd = &cobra.Command{
+		Use:  "list",
+		Long: "Returns the client identities and the certificates each has fetched",
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			identities, err := client.GetIdentities()
+			if err != nil {
+				return err
+			}
+
+			return printJSON(identities)
+		},
+	}
+
+	identityAddCmd = &cobra.Command{
+		Use:  "add name",
+		Long: "Adds a client identity for the domains and returns its secret. The secret is not returned again. With a client certificate subject or SPKI the identity uses the client certificate instead of a secret",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if len(domainArgs) == 0 && !adminArg {
+				return fmt.Errorf("at least one domain is required")
+			}
+
+			if expiresArg < 0 {
+				return fmt.Errorf("expires must not be negative")
+			}
+
+			var expires time.Time
+			if expiresArg > 0 {
+				expires = time.Now().Add(expiresArg)
+			}
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			response, err := client.AddCertificateIdentity(args[0], domainArgs, adminArg, expires, subjectArg, spkiArg)
+			if err != nil {
+				return err
+			}
+
+			return printJSON(response)
+		},
+	}
+
+	identitySPKICmd = &cobra.Command{
+		Use:  "spki certfile",
+		Long: "Returns the base64 SHA-256 hash of the subject public key info of the PEM client certificate for the identity certificateSpki",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			b, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			block, _ := pem.Decode(b)
+			if block == nil {
+				return fmt.Errorf("file %s does not contain a PEM certificate", args[0])
+			}
+
+			x509Cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(types.GetSPKIHash(x509Cert))
+			return nil
+		},
+	}
+
+	identityRevokeCmd = &cobra.Command{
+		Use:  "revoke name",
+		Long: "Revokes the client identity. Tokens already issued to it are no longer valid",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			response, err := client.RevokeIdentity(args[0])
+			if err != nil {
+				return err
+			}
+
+			return printJSON(response)
+		},
+	}
+
+	identityRemoveCmd = &cobra.Command{
+		Use:  "remove name",
+		Long: "Removes a client identity added with the add command",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			response, err := client.RemoveIdentity(args[0])
+			if err != nil {
+				return err
+			}
+
+			return printJSON(response)
+		},
+	}
+
+	enrollmentCmd = &cobra.Command{
+		Use:  "enrollment",
+		Long: "Manages the enrollment tokens of the server using the client config",
+	}
+
+	enrollmentCreateCmd = &cobra.Command{
+		Use:  "create",
+		Long: "Creates a single use enrollment token for the domains. A new client exchanges it with the enroll command for its own identity and secret",
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if len(domainArgs) == 0 {
+				return fmt.Errorf("at least one domain is required")
+			}
 
-				content, err := os.ReadFile(configFile)
+			client, err := getAdminLibClient()
+			if err != nil {
+				return err
+			}
+
+			defer client.Shutdown()
+
+			response, err := client.AddEnrollment(nameArg, domainArgs, lifeArg)
+			if err != nil {
+				return err
+			}
+
+			return printJSON(response)
+		},
+	}
+
+	enrollCmd = &cobra.Command{
+		Use:  "enroll token",
+		Long: "Exchanges the enrollment token for a client identity and writes the identity and its secret to the client config. The config file is created if it does not exist",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			config := &Config{}
+
+			if util.FileExist(getConfigFile()) {
+				x, err := getConfig()
 				if err != nil {
-					return nil, err
+					return err
 				}
+				config = x
+			}
 
-				var config Config
-				err = json.Unmarshal(content, &config)
-				if err == nil {
-					return &config, nil
-				}
+			if config.Client == nil {
+				config.Client = &ClientConfig{}
+			}
+
+			if serverArg != "" {
+				config.Client.Server = serverArg
+			}
 
-				var errs *multierror.Error
+			if skipVerifyArg {
+				config.Client.SkipVerify = true
+			}
 
-				errs = multierror.Append(errs, err)
+			if config.Client.Server == "" {
+				return fmt.Errorf("server is required")
+			}
 
-				err = yaml.Unmarshal(content, &config)
-				if err == nil {
-					return &config, nil
+			name := nameArg
+			if name == "" {
+				hostname, err := os.Hostname()
+				if err != nil {
+					return err
 				}
+				name = hostname
+			}
+
+			response, err := libclient.Enroll(&libclient.Config{
+				Server:     config.Client.Server,
+				SkipVerify: config.Client.SkipVerify,
+			}, args[0], name)
+			if err != nil {
+				return err
+			}
 
-				errs = multierror.Append(errs, err)
+			config.Client.Identity = response.Identity.Name
+			config.Client.Secret = response.Secret
 
-				return nil, errs.ErrorOrNil()
+			err = saveConfig(config)
+			if err != nil {
+				return fmt.Errorf("enrolled as identity %s but the config could not be saved; %w", response.Identity.Name, err)
 			}
 
+			fmt.Printf("Enrolled as identity %s for domains %s; config %s updated\n", response.Identity.Name, strings.Join(response.Identity.Domains, ", "), getConfigFile())
+
+			return nil
+		},
+	}
+
+	runCmd = &cobra.Command{
+
+		Use: "run",
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+
 			errc := make(chan error, 2)
 
 			ctx, cancel := context.WithCancel(cmd.Context())
@@ -258,19 +817,7 @@ var (
 			interruptChan := make(chan os.Signal, 1)
 			signal.Notify(interruptChan, os.Interrupt)
 
-			configFile := configFileArg
-
-			var config *Config
-
-			if configFile == "" {
-				configFile = os.Getenv(ConfigEnvVar)
-			}
-
-			if configFile == "" {
-				configFile = DefaultConfigFile
-			}
-
-			config, err := getConfig(configFile)
+			config, err := getConfig()
 			if err != nil {
 				return err
 			}
@@ -304,7 +851,7 @@ var (
 
 			if config.Server != nil {
 				x, err := server.New(config.Server)
-				if serverRunner != nil {
+				if err != nil {
 					return err
 				}
 				serverRunner = x
@@ -365,7 +912,32 @@ func init() {
 
 	configCmd := getExampleConfigCmd()
 
-	rootCmd.AddCommand(versionCmd, configCmd, runCmd, installCmd)
+	rootCmd.AddCommand(versionCmd, configCmd, runCmd, installCmd, statusCmd, revokeCmd, accountCmd, rateLimitsCmd, identityCmd)
+	rootCmd.AddCommand(enrollmentCmd, enrollCmd)
+	enrollmentCmd.AddCommand(enrollmentCreateCmd)
+	enrollmentCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
+	enrollmentCreateCmd.Flags().StringSliceVarP(&domainArgs, "domain", "d", nil, "domain the enrolled identity may fetch; may be repeated")
+	enrollmentCreateCmd.Flags().StringVarP(&nameArg, "name", "n", "", "name of the enrolled identity; default is the name given by the client")
+	enrollmentCreateCmd.Flags().DurationVarP(&lifeArg, "life", "l", 0, "duration until the token expires; default is 1h")
+	enrollCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
+	enrollCmd.Flags().StringVarP(&serverArg, "server", "s", "", "server URL; default is the client config server")
+	enrollCmd.Flags().StringVarP(&nameArg, "name", "n", "", "identity name if the token does not set one; default is the hostname")
+	enrollCmd.Flags().BoolVar(&skipVerifyArg, "skip-verify", false, "skip verification of the server certificate")
+	identityCmd.AddCommand(identityListCmd, identityAddCmd, identitySPKICmd, identityRevokeCmd, identityRemoveCmd)
+	identityCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
+	identityAddCmd.Flags().StringSliceVarP(&domainArgs, "domain", "d", nil, "domain the identity may fetch; may be repeated")
+	identityAddCmd.Flags().BoolVar(&adminArg, "admin", false, "allow the identity to make admin requests")
+	identityAddCmd.Flags().DurationVarP(&expiresArg, "expires", "e", 0, "duration until the identity expires; default is never")
+	identityAddCmd.Flags().StringVar(&subjectArg, "subject", "", "client certificate subject common name or distinguished name; requires the server clientCa")
+	identityAddCmd.Flags().StringVar(&spkiArg, "spki", "", "client certificate SPKI hash from the spki command")
+	accountCmd.AddCommand(accountListCmd, accountURLCmd, accountRotateKeyCmd, accountUpdateCmd, accountDeactivateCmd)
+	accountCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
+	accountUpdateCmd.Flags().StringSliceVarP(&emailArgs, "email", "e", nil, "contact email; may be repeated")
+	statusCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
+	rateLimitsCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
+	revokeCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
+	revokeCmd.PersistentFlags().StringVarP(&keyAlgorithmArg, "key-algorithm", "k", "", "key algorithm (rsa or ecdsa) of the certificate; default is the domain key algorithm")
+	revokeCmd.PersistentFlags().StringVarP(&reasonArg, "reason", "r", string(types.RevocationReasonUnspecified), "revocation reason name or code")
 	runCmd.PersistentFlags().StringVarP(&configFileArg, "config", "c", "", fmt.Sprintf("config file; env var is %s", ConfigEnvVar))
 	runCmd.PersistentFlags().StringVarP(&debugLevelArg, "debug", "D", "", fmt.Sprintf("debug level (TRACE, DEBUG, INFO, WARN, ERROR) to STDERR; env var is %s", ConfigEnvVar))
 }
@@ -12,9 +12,32 @@ type TokenResponse = types.TokenResponse
 type Token = hashauthserver.Token
 type CertResponse = types.CertResponse
 type CR = types.CR
+type KeyAlgorithm = types.KeyAlgorithm
+type StatusResponse = types.StatusResponse
+type RevokeResponse = types.RevokeResponse
+type RevocationReason = types.RevocationReason
+type Account = types.Account
+type AccountsResponse = types.AccountsResponse
+type AccountResponse = types.AccountResponse
+type RateLimitStatus = types.RateLimitStatus
+type RateLimitsResponse = types.RateLimitsResponse
+type ClientIdentity = types.ClientIdentity
+type ClientIdentitiesResponse = types.ClientIdentitiesResponse
+type ClientIdentityResponse = types.ClientIdentityResponse
+type Enrollment = types.Enrollment
+type EnrollmentResponse = types.EnrollmentResponse
+type EnrollRequest = types.EnrollRequest
 
+// Config is the libclient config. Identity is the name of the client identity
+// the secret belongs to; it is empty for the global and domain secrets.
+// ClientCert and ClientKey are the PEM files of a client certificate presented
+// to the server; they are read on each connection so they may be renewed in
+// place. If Secret is empty the client certificate is the only credential
 type Config struct {
+	Identity   string `json:"identity,omitempty" yaml:"identity,omitempty"`
 	Secret     string `json:"secret" yaml:"secret"`
+	ClientCert string `json:"clientCert,omitempty" yaml:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty" yaml:"clientKey,omitempty"`
 	Server     string `json:"server" yaml:"server"`
 	SkipVerify bool   `json:"skipVerify" yaml:"skipVerify"`
 }
@@ -8,16 +8,20 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	hashauthrand "github.com/jodydadescott/simple-go-hash-auth/rand"
 	hashauthserver "github.com/jodydadescott/simple-go-hash-auth/server"
+
+	"github.com/jodydadescott/home-simplecert/types"
 )
 
 type Client struct {
 	mutex      sync.Mutex
 	secret     string
+	identity   string
 	url        string
 	httpClient *http.Client
 	token      *hashauthserver.Token
@@ -31,21 +35,40 @@ func New(config *Config) *Client {
 		panic("config is nil")
 	}
 
-	if config.Secret == "" {
-		panic("secret is empty")
+	if config.Secret == "" && config.ClientCert == "" {
+		panic("secret and client cert are empty")
+	}
+
+	if config.ClientCert != "" && config.ClientKey == "" {
+		panic("client key is empty")
 	}
 
 	if config.Server == "" {
 		panic("url is empty")
 	}
 
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipVerify}
+
+	if config.ClientCert != "" {
+		clientCert := config.ClientCert
+		clientKey := config.ClientKey
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client cert %s; %w", clientCert, err)
+			}
+			return &cert, nil
+		}
+	}
+
 	return &Client{
-		url:     config.Server,
-		secret:  config.Secret,
-		rand:    hashauthrand.New(&hashauthrand.Config{}),
-		certMap: make(map[string]*CR),
+		url:      config.Server,
+		secret:   config.Secret,
+		identity: config.Identity,
+		rand:     hashauthrand.New(&hashauthrand.Config{}),
+		certMap:  make(map[string]*CR),
 		httpClient: &http.Client{Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipVerify},
+			TLSClientConfig: tlsConfig,
 		}},
 	}
 }
@@ -57,36 +80,375 @@ func (t *Client) Shutdown() {
 }
 
 func (t *Client) GetCert(domain string) (*CR, error) {
+	return t.GetCertForKeyAlgorithm(domain, types.KeyAlgorithmEmpty)
+}
+
+// GetCertForKeyAlgorithm returns the cert for the domain with the key algorithm. If
+// the key algorithm is empty the server returns the default cert for the domain
+func (t *Client) GetCertForKeyAlgorithm(domain string, keyAlgorithm KeyAlgorithm) (*CR, error) {
 
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	cert := t.certMap[domain]
+	key := domain
+	if keyAlgorithm != types.KeyAlgorithmEmpty {
+		key = domain + "/" + string(keyAlgorithm)
+	}
+
+	cert := t.certMap[key]
 
 	if cert != nil {
 		return cert, nil
 	}
 
-	token, err := t.getToken()
+	result, err := t.getCertResponse(domain, keyAlgorithm, "")
+	if err != nil {
+		return nil, err
+	}
+
+	t.certMap[key] = result.CR
+	return result.CR, nil
+}
+
+// GetCertResponse returns the cert response for the domain with the key algorithm
+// and the named chain. If the chain is empty the server returns the default chain.
+// Unlike GetCert the response is always fetched from the server so a renewed cert
+// and its lifetime are returned
+func (t *Client) GetCertResponse(domain string, keyAlgorithm KeyAlgorithm, chain string) (*CertResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result, err := t.getCertResponse(domain, keyAlgorithm, chain)
 	if err != nil {
 		return nil, err
 	}
 
-	bearer := "Bearer " + token.Token
+	if chain == "" {
+		key := domain
+		if keyAlgorithm != types.KeyAlgorithmEmpty {
+			key = domain + "/" + string(keyAlgorithm)
+		}
+		t.certMap[key] = result.CR
+	}
+
+	return result, nil
+}
+
+func (t *Client) getCertResponse(domain string, keyAlgorithm KeyAlgorithm, chain string) (*CertResponse, error) {
+
+	params := url.Values{}
+	params.Add("domain", domain)
+
+	if keyAlgorithm != types.KeyAlgorithmEmpty {
+		params.Add("keyAlgorithm", string(keyAlgorithm))
+	}
+
+	if chain != "" {
+		params.Add("chain", chain)
+	}
+
+	var result CertResponse
+	err := t.get("/getcert", params, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	if result.CR == nil {
+		return nil, fmt.Errorf("no CR in response")
+	}
+
+	return &result, nil
+}
+
+// GetStatus returns the status of the server domains
+func (t *Client) GetStatus() (*StatusResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var result StatusResponse
+	err := t.get("/getstatus", url.Values{}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	return &result, nil
+}
+
+// Revoke revokes the current cert for the domain with the key algorithm and the
+// reason. The server reissues the cert immediately and returns its serial
+func (t *Client) Revoke(domain string, keyAlgorithm KeyAlgorithm, reason RevocationReason) (*RevokeResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
 	params := url.Values{}
 	params.Add("domain", domain)
 
-	req, err := http.NewRequest(http.MethodGet, t.url+"/getcert?"+params.Encode(), nil)
+	if keyAlgorithm != types.KeyAlgorithmEmpty {
+		params.Add("keyAlgorithm", string(keyAlgorithm))
+	}
+
+	if reason != types.RevocationReasonEmpty {
+		params.Add("reason", string(reason))
+	}
+
+	var result RevokeResponse
+	err := t.do(http.MethodPost, "/revoke", params, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cached cert was revoked
+	for key := range t.certMap {
+		if key == domain || strings.HasPrefix(key, domain+"/") {
+			delete(t.certMap, key)
+		}
+	}
+
+	if result.Error != "" {
+		return &result, fmt.Errorf(result.Error)
+	}
+
+	return &result, nil
+}
+
+// GetAccounts returns the ACME accounts of the server domains
+func (t *Client) GetAccounts() (*AccountsResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
+	var result AccountsResponse
+	err := t.get("/getaccounts", url.Values{}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	return &result, nil
+}
+
+// GetRateLimits returns the headroom of the CA rate limits for the server domains
+func (t *Client) GetRateLimits() (*RateLimitsResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var result RateLimitsResponse
+	err := t.get("/getratelimits", url.Values{}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	return &result, nil
+}
+
+// RotateAccountKey replaces the ACME account key of the domain
+func (t *Client) RotateAccountKey(domain string) (*Account, error) {
+	return t.postAccount("/rotateaccountkey", domain, url.Values{})
+}
+
+// UpdateAccountContacts replaces the ACME account contacts of the domain with the emails
+func (t *Client) UpdateAccountContacts(domain string, emails []string) (*Account, error) {
+	return t.postAccount("/updateaccount", domain, url.Values{"email": emails})
+}
+
+// DeactivateAccount deactivates the ACME account of the domain. The server
+// registers a new account on the next renewal
+func (t *Client) DeactivateAccount(domain string) (*Account, error) {
+	return t.postAccount("/deactivateaccount", domain, url.Values{})
+}
+
+func (t *Client) postAccount(path string, domain string, params url.Values) (*Account, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	params.Add("domain", domain)
+
+	var result AccountResponse
+	err := t.do(http.MethodPost, path, params, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	return result.Account, nil
+}
+
+// GetIdentities returns the client identities of the server
+func (t *Client) GetIdentities() (*ClientIdentitiesResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var result ClientIdentitiesResponse
+	err := t.get("/getidentities", url.Values{}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	return &result, nil
+}
+
+// AddIdentity adds a client identity for the domains to the server registry. The
+// response has the identity secret, which is not returned again. If expires is
+// zero the identity does not expire
+func (t *Client) AddIdentity(name string, domains []string, admin bool, expires time.Time) (*ClientIdentityResponse, error) {
+	return t.AddCertificateIdentity(name, domains, admin, expires, "", "")
+}
+
+// AddCertificateIdentity adds a client identity for the domains that is mapped
+// to a client certificate by its subject or the base64 SHA-256 hash of its SPKI.
+// If both are empty the identity has a secret like AddIdentity
+func (t *Client) AddCertificateIdentity(name string, domains []string, admin bool, expires time.Time, subject string, spki string) (*ClientIdentityResponse, error) {
+
+	params := url.Values{"domain": domains}
+
+	if subject != "" {
+		params.Add("subject", subject)
+	}
+
+	if spki != "" {
+		params.Add("spki", spki)
+	}
+
+	if admin {
+		params.Add("admin", "true")
+	}
+
+	if !expires.IsZero() {
+		params.Add("expires", expires.Format(time.RFC3339))
+	}
+
+	return t.postIdentity("/addidentity", name, params)
+}
+
+// RevokeIdentity revokes the client identity. Its tokens are invalid at once
+func (t *Client) RevokeIdentity(name string) (*ClientIdentityResponse, error) {
+	return t.postIdentity("/revokeidentity", name, url.Values{})
+}
+
+// RemoveIdentity removes the client identity from the server registry
+func (t *Client) RemoveIdentity(name string) (*ClientIdentityResponse, error) {
+	return t.postIdentity("/removeidentity", name, url.Values{})
+}
+
+func (t *Client) postIdentity(path string, name string, params url.Values) (*ClientIdentityResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	params.Add("name", name)
+
+	var result ClientIdentityResponse
+	err := t.do(http.MethodPost, path, params, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	return &result, nil
+}
+
+// AddEnrollment adds a single use enrollment token for the domains that expires
+// after life. If life is zero the server default is used. If name is empty the
+// enrolling client names its identity
+func (t *Client) AddEnrollment(name string, domains []string, life time.Duration) (*EnrollmentResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	params := url.Values{"domain": domains}
+
+	if name != "" {
+		params.Add("name", name)
+	}
+
+	if life > 0 {
+		params.Add("life", life.String())
+	}
+
+	var result EnrollmentResponse
+	err := t.do(http.MethodPost, "/addenrollment", params, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, fmt.Errorf(result.Error)
+	}
+
+	return &result, nil
+}
+
+// Enroll exchanges the enrollment token for a client identity with its own
+// secret. Only the config Server and SkipVerify are used as the client does not
+// have a credential yet. Name is the identity name used if the enrollment does
+// not have one
+func Enroll(config *Config, token string, name string) (*ClientIdentityResponse, error) {
+
+	if config == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	if config.Server == "" {
+		return nil, fmt.Errorf("server is required")
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("token is required")
+	}
+
+	b, err := json.Marshal(&EnrollRequest{
+		Token: token,
+		Name:  name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipVerify},
+	}}
+
+	defer httpClient.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodPost, config.Server+"/enroll", bytes.NewBuffer(b))
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Add("Authorization", bearer)
 
-	resp, err := t.httpClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -97,13 +459,13 @@ func (t *Client) GetCert(domain string) (*CR, error) {
 
 	defer resp.Body.Close()
 
-	bytes, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	var result CertResponse
-	err = json.Unmarshal(bytes, &result)
+	var result ClientIdentityResponse
+	err = json.Unmarshal(body, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -112,12 +474,57 @@ func (t *Client) GetCert(domain string) (*CR, error) {
 		return nil, fmt.Errorf(result.Error)
 	}
 
-	if result.CR == nil {
-		return nil, fmt.Errorf("no CR in response")
+	if result.Identity == nil || result.Secret == "" {
+		return nil, fmt.Errorf("no identity in response")
 	}
 
-	t.certMap[domain] = result.CR
-	return result.CR, nil
+	return &result, nil
+}
+
+// get sends an authorized GET request for path and unmarshals the response into result
+func (t *Client) get(path string, params url.Values, result any) error {
+	return t.do(http.MethodGet, path, params, result)
+}
+
+// do sends an authorized request for path and unmarshals the response into result.
+// Without a secret the request is authorized by the client certificate
+func (t *Client) do(method string, path string, params url.Values, result any) error {
+
+	req, err := http.NewRequest(method, t.url+path+"?"+params.Encode(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if t.secret != "" {
+
+		token, err := t.getToken()
+		if err != nil {
+			return err
+		}
+
+		req.Header.Add("Authorization", "Bearer "+token.Token)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bytes, result)
 }
 
 func (t *Client) getToken() (*Token, error) {
@@ -178,7 +585,12 @@ func (t *Client) getToken() (*Token, error) {
 			return err
 		}
 
-		req, err := http.NewRequest("GET", t.url+"/getauthtoken", bytes.NewBuffer(b))
+		path := "/getauthtoken"
+		if t.identity != "" {
+			path += "?" + url.Values{"identity": []string{t.identity}}.Encode()
+		}
+
+		req, err := http.NewRequest("GET", t.url+path, bytes.NewBuffer(b))
 		req.Header.Set("Content-Type", "application/json")
 
 		if err != nil {
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"go.uber.org/zap"
+)
+
+// getJWK returns the JSON Web Key (RFC 7517) of the RSA public key. The members
+// are in lexicographic order so the JSON is also the RFC 7638 thumbprint input
+func getJWK(key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+	}
+}
+
+// getKeyThumbprint returns the RFC 7638 thumbprint of the RSA public key
+func getKeyThumbprint(key *rsa.PublicKey) string {
+	b, _ := json.Marshal(getJWK(key))
+	hash := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// newJWS returns the JWS with the protected header and payload signed with the key
+func newJWS(key *rsa.PrivateKey, protected map[string]any, payload any) (*flattenedJWS, error) {
+
+	protected["alg"] = "RS256"
+
+	protectedBytes, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	jws := &flattenedJWS{
+		Protected: base64.RawURLEncoding.EncodeToString(protectedBytes),
+		Payload:   base64.RawURLEncoding.EncodeToString(payloadBytes),
+	}
+
+	err = jws.sign(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return jws, nil
+}
+
+// getAccount returns the account of the domain from the cache directory
+func (t *DomainWrapper) getAccount() (*Account, error) {
+
+	user, err := t.loadUser()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("domain %s does not have an account", t.Name)
+		}
+		return nil, err
+	}
+
+	account := &Account{
+		Domain:               t.Name,
+		Email:                user.Email,
+		DirectoryURL:         user.DirectoryURL,
+		ExternalAccountKeyID: user.ExternalAccountKeyID,
+	}
+
+	if user.Key != nil {
+		account.KeyThumbprint = getKeyThumbprint(&user.Key.PublicKey)
+	}
+
+	if user.Registration != nil {
+		account.URL = user.Registration.URI
+		account.Status = user.Registration.Body.Status
+		account.Contact = user.Registration.Body.Contact
+	}
+
+	return account, nil
+}
+
+// getRegisteredUser returns the account if it is registered with the ACME server
+// of the domain
+func (t *DomainWrapper) getRegisteredUser() (*User, error) {
+
+	user, err := t.loadUser()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("domain %s does not have an account", t.Name)
+		}
+		return nil, err
+	}
+
+	if user.Registration == nil || user.Registration.URI == "" {
+		return nil, fmt.Errorf("domain %s account is not registered", t.Name)
+	}
+
+	if user.DirectoryURL != t.getDirectoryURL() {
+		return nil, fmt.Errorf("domain %s account is registered with %s and not %s", t.Name, user.DirectoryURL, t.getDirectoryURL())
+	}
+
+	return user, nil
+}
+
+// lockRenewals stops the domain and its variant renewing while the account they
+// share is changed
+func (t *DomainWrapper) lockRenewals() {
+	t.renewMutex.Lock()
+	if t.variant != nil {
+		t.variant.renewMutex.Lock()
+	}
+}
+
+func (t *DomainWrapper) unlockRenewals() {
+	if t.variant != nil {
+		t.variant.renewMutex.Unlock()
+	}
+	t.renewMutex.Unlock()
+}
+
+// rotateAccountKey replaces the account key with a new key using the ACME
+// key-change request (RFC 8555 section 7.3.5). lego does not support key-change
+// so the request is signed here. The inner JWS is signed with the new key and
+// the outer JWS with the old key
+func (t *DomainWrapper) rotateAccountKey() (*Account, error) {
+
+	t.lockRenewals()
+	defer t.unlockRenewals()
+
+	user, err := t.getRegisteredUser()
+	if err != nil {
+		return nil, err
+	}
+
+	core, err := t.getCore()
+	if err != nil {
+		return nil, err
+	}
+
+	keyChangeURL := core.GetDirectory().KeyChangeURL
+	if keyChangeURL == "" {
+		return nil, fmt.Errorf("ACME server %s does not support key change", t.getDirectoryURL())
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate account key; %w", err)
+	}
+
+	inner, err := newJWS(key, map[string]any{
+		"jwk": getJWK(&key.PublicKey),
+		"url": keyChangeURL,
+	}, map[string]any{
+		"account": user.Registration.URI,
+		"oldKey":  getJWK(&user.Key.PublicKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := t.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := getNonce(httpClient, core.GetDirectory().NewNonceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	outer, err := newJWS(user.Key, map[string]any{
+		"kid":   user.Registration.URI,
+		"nonce": nonce,
+		"url":   keyChangeURL,
+	}, inner)
+	if err != nil {
+		return nil, err
+	}
+
+	err = postJWS(httpClient, keyChangeURL, outer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to change account key; %w", err)
+	}
+
+	oldThumbprint := getKeyThumbprint(&user.Key.PublicKey)
+
+	user.Key = key
+
+	err = t.saveUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("account key was changed but the account could not be saved; %w", err)
+	}
+
+	zap.L().Info(fmt.Sprintf("Domain %s account %s key changed from %s to %s", t.Name, user.Registration.URI, oldThumbprint, getKeyThumbprint(&key.PublicKey)))
+
+	return t.getAccount()
+}
+
+// updateAccountContacts replaces the account contacts with the email addresses
+func (t *DomainWrapper) updateAccountContacts(emails []string) (*Account, error) {
+
+	t.lockRenewals()
+	defer t.unlockRenewals()
+
+	user, err := t.getRegisteredUser()
+	if err != nil {
+		return nil, err
+	}
+
+	var contact []string
+	for _, email := range emails {
+		email = strings.TrimPrefix(strings.TrimSpace(email), "mailto:")
+		if email == "" {
+			continue
+		}
+		contact = append(contact, "mailto:"+email)
+	}
+
+	if len(contact) == 0 {
+		return nil, fmt.Errorf("at least one email is required")
+	}
+
+	core, err := t.getCore()
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := core.Accounts.Update(user.Registration.URI, acme.Account{Contact: contact})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update account contacts; %w", err)
+	}
+
+	user.Registration.Body = account
+
+	user.Email = strings.TrimPrefix(contact[0], "mailto:")
+
+	err = t.saveUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("account contacts were updated but the account could not be saved; %w", err)
+	}
+
+	zap.L().Info(fmt.Sprintf("Domain %s account %s contacts updated to %v", t.Name, user.Registration.URI, contact))
+
+	return t.getAccount()
+}
+
+// deactivateAccount deactivates the account with the ACME server. The account
+// file is kept in the cache directory with the time it was deactivated and a
+// new account is registered on the next renewal
+func (t *DomainWrapper) deactivateAccount() (*Account, error) {
+
+	t.lockRenewals()
+	defer t.unlockRenewals()
+
+	user, err := t.getRegisteredUser()
+	if err != nil {
+		return nil, err
+	}
+
+	core, err := t.getCore()
+	if err != nil {
+		return nil, err
+	}
+
+	err = core.Accounts.Deactivate(user.Registration.URI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deactivate account; %w", err)
+	}
+
+	user.Registration.Body.Status = acme.StatusDeactivated
+
+	err = t.saveUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := t.getAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	userFile := t.getUserFile()
+	name := fmt.Sprintf("%s.deactivated.%d", filepath.Base(userFile), time.Now().Unix())
+
+	err = os.Rename(userFile, filepath.Join(filepath.Dir(userFile), name))
+	if err != nil {
+		return nil, err
+	}
+
+	zap.L().Info(fmt.Sprintf("Domain %s account %s deactivated and saved as %s; a new account will be registered on the next renewal", t.Name, user.Registration.URI, name))
+
+	return account, nil
+}
+
+// getNonce returns a new nonce from the ACME server
+func getNonce(httpClient *http.Client, newNonceURL string) (string, error) {
+
+	resp, err := httpClient.Head(newNonceURL)
+	if err != nil {
+		return "", err
+	}
+
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("%s did not return a nonce", newNonceURL)
+	}
+
+	return nonce, nil
+}
+
+// postJWS posts the JWS and returns the ACME problem as an error if the request failed
+func postJWS(httpClient *http.Client, url string, jws *flattenedJWS) error {
+
+	b, err := json.Marshal(jws)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/jose+json")
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+
+	problem := &acme.ProblemDetails{}
+	if json.Unmarshal(body, problem) == nil && problem.Detail != "" {
+		return fmt.Errorf("%s returned status %d; %s %s", url, resp.StatusCode, problem.Type, problem.Detail)
+	}
+
+	return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+}
+
+// getAccounts returns the account of every domain sorted by domain name. Domains
+// that have not registered an account are skipped
+func (t *Server) getAccounts() []*Account {
+
+	var accounts []*Account
+
+	for _, domain := range t.getSortedDomains() {
+		account, err := domain.getAccount()
+		if err != nil {
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts
+}
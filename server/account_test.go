@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-acme/lego/v4/registration"
+)
+
+func TestSharedExternalAccount(t *testing.T) {
+
+	s := &Server{
+		cacheDir:               t.TempDir(),
+		directoryURL:           DirectoryURLStaging,
+		externalAccountBinding: &ExternalAccountBinding{KeyID: "kid-1", HMACKey: "hmac"},
+	}
+
+	newDomain := func(domain *Domain) *DomainWrapper {
+		return &DomainWrapper{Domain: domain, Server: s}
+	}
+
+	domain1 := newDomain(&Domain{Name: "example1.com"})
+	domain2 := newDomain(&Domain{Name: "example2.com"})
+	domain3 := newDomain(&Domain{Name: "example3.com", ExternalAccountBinding: &ExternalAccountBinding{KeyID: "kid-2", HMACKey: "hmac"}})
+	domain4 := newDomain(&Domain{Name: "example4.com", DirectoryURL: DirectoryURLProduction})
+	domain5 := &DomainWrapper{Domain: &Domain{Name: "example5.com"}, Server: &Server{cacheDir: s.cacheDir, directoryURL: DirectoryURLStaging}}
+
+	if domain1.getUserFile() != domain2.getUserFile() {
+		t.Fatal("expected domains with the same external account binding to share an account")
+	}
+
+	for _, domain := range []*DomainWrapper{domain3, domain4} {
+		if domain.getUserFile() == domain1.getUserFile() {
+			t.Fatalf("expected domain %s to have its own account", domain.Name)
+		}
+	}
+
+	if domain5.getUserFile() != filepath.Join(domain5.getCacheDir(), UserFileName) {
+		t.Fatal("expected an account without an external account binding to be kept in the domain cache directory")
+	}
+
+	// An account registered before accounts were shared is moved to the shared file
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(domain1.getCacheDir(), CacheDirPerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := &DomainWrapper{Domain: domain1.Domain, Server: &Server{cacheDir: s.cacheDir, directoryURL: s.directoryURL}}
+
+	err = legacy.saveUser(&User{
+		Email:                "nobody@example.com",
+		Key:                  key,
+		DirectoryURL:         DirectoryURLStaging,
+		ExternalAccountKeyID: "kid-1",
+		Registration:         &registration.Resource{URI: "https://ca.example.com/acct/1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = domain2.loadUser()
+	if err == nil {
+		t.Fatal("expected domain2 to not find the account in its own cache directory")
+	}
+
+	user, err := domain1.loadUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Registration == nil || user.Registration.URI != "https://ca.example.com/acct/1" {
+		t.Fatal("expected the registered account to be moved")
+	}
+
+	user, err = domain2.loadUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Registration.URI != "https://ca.example.com/acct/1" {
+		t.Fatal("expected domain2 to use the shared account")
+	}
+}
+
+// verifyTestJWS checks the JWS was signed with the key
+func verifyTestJWS(t *testing.T, jws *testJWS, key *rsa.PublicKey) {
+
+	t.Helper()
+
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	if err != nil {
+		t.Fatalf("expected the JWS to be signed with the key; %s", err)
+	}
+}
+
+// getTestJWKKey returns the RSA public key of the JWK
+func getTestJWKKey(t *testing.T, jwk any) *rsa.PublicKey {
+
+	t.Helper()
+
+	members, ok := jwk.(map[string]any)
+	if !ok {
+		t.Fatalf("expected a JWK, got %v", jwk)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(members["n"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(members["e"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+}
+
+func TestRotateAccountKey(t *testing.T) {
+
+	acme := newTestACME(t)
+
+	domain := newTestRegisteredDomain(t, acme, nil)
+
+	oldUser, err := domain.loadUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := domain.rotateAccountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := acme.getRequests("/key-change")
+	if len(requests) != 1 {
+		t.Fatalf("expected one key change request, got %d", len(requests))
+	}
+
+	// The outer JWS is signed by the account with the old key
+	outer := requests[0]
+
+	if outer.protected["kid"] != oldUser.Registration.URI {
+		t.Fatalf("expected the request to be signed by the account, got %v", outer.protected["kid"])
+	}
+
+	if outer.protected["url"] != acme.server.URL+"/key-change" || outer.protected["nonce"] == nil {
+		t.Fatalf("expected the key change url and a nonce, got %v", outer.protected)
+	}
+
+	verifyTestJWS(t, outer, &oldUser.Key.PublicKey)
+
+	// The inner JWS is signed with the new key and names the account and old key
+	inner, err := decodeTestJWS(outer.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inner.protected["url"] != outer.protected["url"] || inner.protected["nonce"] != nil || inner.protected["kid"] != nil {
+		t.Fatalf("expected the inner header to only have the url and jwk, got %v", inner.protected)
+	}
+
+	newKey := getTestJWKKey(t, inner.protected["jwk"])
+
+	verifyTestJWS(t, inner, newKey)
+
+	message := &struct {
+		Account string         `json:"account"`
+		OldKey  map[string]any `json:"oldKey"`
+	}{}
+
+	err = json.Unmarshal(inner.payload, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Account != oldUser.Registration.URI {
+		t.Fatalf("expected account %s, got %s", oldUser.Registration.URI, message.Account)
+	}
+
+	if getTestJWKKey(t, message.OldKey).N.Cmp(oldUser.Key.N) != 0 {
+		t.Fatal("expected the old key to be the account key")
+	}
+
+	// The new key is saved with the account
+	user, err := domain.loadUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Key.N.Cmp(newKey.N) != 0 || user.Key.N.Cmp(oldUser.Key.N) == 0 {
+		t.Fatal("expected the new key to be saved")
+	}
+
+	if user.Registration.URI != oldUser.Registration.URI {
+		t.Fatalf("expected the account %s to be kept, got %s", oldUser.Registration.URI, user.Registration.URI)
+	}
+
+	if account.KeyThumbprint != getKeyThumbprint(newKey) {
+		t.Fatalf("expected the thumbprint of the new key, got %s", account.KeyThumbprint)
+	}
+
+	// A refused key change keeps the key
+	acme.setProblem("/key-change", http.StatusBadRequest)
+
+	_, err = domain.rotateAccountKey()
+	if err == nil {
+		t.Fatal("expected a refused key change to fail")
+	}
+
+	user, err = domain.loadUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Key.N.Cmp(newKey.N) != 0 {
+		t.Fatal("expected the key to be kept when the key change is refused")
+	}
+}
@@ -0,0 +1,833 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns"
+	"github.com/go-acme/lego/v4/providers/http/webroot"
+	"github.com/go-acme/lego/v4/registration"
+	logger "github.com/jodydadescott/jody-go-logger"
+	"go.uber.org/zap"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+// envMutex serializes changes to the process environment. The lego DNS providers
+// read their credentials from the environment when they are created so the
+// credentials for a domain are only set while its provider is being created
+var envMutex sync.Mutex
+
+// User implements the lego registration.User interface. The JSON format matches
+// the SSLUser.json file written by simplecert so existing accounts are reused.
+// DirectoryURL records the ACME server the account is registered with; files
+// written by simplecert do not have it and are assumed to be production.
+// ExternalAccountKeyID records the external account binding used to register.
+type User struct {
+	Email                string                 `json:"Email"`
+	Registration         *registration.Resource `json:"Registration"`
+	Key                  *rsa.PrivateKey        `json:"Key"`
+	DirectoryURL         string                 `json:"DirectoryURL,omitempty"`
+	ExternalAccountKeyID string                 `json:"ExternalAccountKeyID,omitempty"`
+}
+
+func (t *User) GetEmail() string {
+	return t.Email
+}
+
+func (t *User) GetRegistration() *registration.Resource {
+	return t.Registration
+}
+
+func (t *User) GetPrivateKey() crypto.PrivateKey {
+	return t.Key
+}
+
+// getDirectoryURL returns the ACME directory URL for s. The names production
+// and staging are shortcuts for the Let's Encrypt directories
+func getDirectoryURL(s string) string {
+
+	switch strings.ToLower(s) {
+
+	case "", DirectoryProduction:
+		return DirectoryURLProduction
+
+	case DirectoryStaging:
+		return DirectoryURLStaging
+
+	}
+
+	return s
+}
+
+// loadCABundle returns a cert pool with the PEM certificates in the named file
+func loadCABundle(name string) (*x509.CertPool, error) {
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s; %w", name, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("CA bundle %s does not contain any PEM certificates", name)
+	}
+
+	return pool, nil
+}
+
+func (t *DomainWrapper) getDirectoryURL() string {
+	if t.Domain.DirectoryURL != "" {
+		return getDirectoryURL(t.Domain.DirectoryURL)
+	}
+	return t.Server.directoryURL
+}
+
+func (t *DomainWrapper) getCABundle() string {
+	if t.Domain.CABundle != "" {
+		return t.Domain.CABundle
+	}
+	return t.Server.caBundle
+}
+
+func (t *DomainWrapper) getExternalAccountBinding() *ExternalAccountBinding {
+	if t.Domain.ExternalAccountBinding != nil {
+		return t.Domain.ExternalAccountBinding
+	}
+	return t.Server.externalAccountBinding
+}
+
+func (t *DomainWrapper) getProfile() string {
+	if t.Domain.Profile != "" {
+		return t.Domain.Profile
+	}
+	return t.Server.profile
+}
+
+func (t *DomainWrapper) getKeyType() KeyType {
+	return t.keyType
+}
+
+func getCertcryptoKeyType(keyType KeyType) certcrypto.KeyType {
+
+	switch keyType {
+
+	case types.KeyTypeRSA4096:
+		return certcrypto.RSA4096
+
+	case types.KeyTypeRSA8192:
+		return certcrypto.RSA8192
+
+	case types.KeyTypeEC256:
+		return certcrypto.EC256
+
+	case types.KeyTypeEC384:
+		return certcrypto.EC384
+
+	}
+
+	return certcrypto.RSA2048
+}
+
+// getCacheDir returns the domain cache directory. The ACME account is kept here
+func (t *DomainWrapper) getCacheDir() string {
+	return filepath.Join(t.cacheDir, getCacheDirName(t.Name))
+}
+
+// getCacheDirName returns the cache directory name for the domain name. The
+// wildcard label is replaced as it is awkward to have in a path
+func getCacheDirName(name string) string {
+	return strings.ReplaceAll(name, WildcardLabel, WildcardCacheDirLabel)
+}
+
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, WildcardPrefix)
+}
+
+// validateDomainName returns an error if the name is not a valid domain name.
+// A wildcard is only allowed as the entire left most label
+func validateDomainName(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("domain name is empty")
+	}
+
+	labels := strings.Split(name, ".")
+
+	for i, label := range labels {
+
+		if label == "" {
+			return fmt.Errorf("domain name %s has an empty label", name)
+		}
+
+		if strings.Contains(label, WildcardLabel) {
+
+			if i != 0 || label != WildcardLabel {
+				return fmt.Errorf("domain name %s has an invalid wildcard; only *.example.com is supported", name)
+			}
+
+			if len(labels) < 3 {
+				return fmt.Errorf("domain name %s is a wildcard for a top level domain", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchDomainName returns true if the name is equal to pattern or is covered by
+// the wildcard pattern. A wildcard covers exactly one label
+func matchDomainName(pattern, name string) bool {
+
+	if strings.EqualFold(pattern, name) {
+		return true
+	}
+
+	if !isWildcard(pattern) {
+		return false
+	}
+
+	i := strings.Index(name, ".")
+	if i <= 0 {
+		return false
+	}
+
+	return strings.EqualFold(strings.TrimPrefix(pattern, WildcardLabel), name[i:])
+}
+
+// covers returns true if the name is the domain name, an alias or covered by a wildcard
+func (t *DomainWrapper) covers(name string) bool {
+	for _, domain := range t.getDomains() {
+		if matchDomainName(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertDir returns the directory the certificate is kept in. This is the domain
+// cache directory except for the alternate certificate of a dual domain
+func (t *DomainWrapper) getCertDir() string {
+	if t.certDir != "" {
+		return t.certDir
+	}
+	return t.getCacheDir()
+}
+
+// getDomains returns the domain name followed by the aliases
+func (t *DomainWrapper) getDomains() []string {
+	var domains []string
+	domains = append(domains, t.Name)
+	domains = append(domains, t.Aliases...)
+	return domains
+}
+
+func (t *DomainWrapper) getChallengeType() ChallengeType {
+
+	if t.Challenge == nil {
+		return ChallengeTypeHTTP
+	}
+
+	challengeType := ChallengeTypeFromString(t.Challenge.Type)
+	if challengeType != ChallengeTypeEmpty {
+		return challengeType
+	}
+
+	if t.Challenge.Provider != "" {
+		return ChallengeTypeDNS
+	}
+
+	return ChallengeTypeHTTP
+}
+
+// getUserFile returns the account file. An account registered with an external
+// account binding is shared by every domain with the same directory URL and
+// key ID as CAs such as Google Trust Services only allow a key ID to be used
+// once. It is kept in the accounts directory of the server cache directory.
+// Other accounts are kept in the domain cache directory
+func (t *DomainWrapper) getUserFile() string {
+
+	eab := t.getExternalAccountBinding()
+	if eab == nil {
+		return filepath.Join(t.getCacheDir(), UserFileName)
+	}
+
+	hash := sha256.Sum256([]byte(t.getDirectoryURL() + " " + eab.KeyID))
+
+	return filepath.Join(t.cacheDir, AccountsDirName, hex.EncodeToString(hash[:16])+".json")
+}
+
+// loadUser loads the account from the account file. An account registered with
+// an external account binding before accounts were shared is moved from the
+// domain cache directory to the shared account file
+func (t *DomainWrapper) loadUser() (*User, error) {
+
+	b, err := os.ReadFile(t.getUserFile())
+	if err != nil {
+
+		if !os.IsNotExist(err) || t.getUserFile() == filepath.Join(t.getCacheDir(), UserFileName) {
+			return nil, err
+		}
+
+		user, domainErr := t.loadDomainUser()
+		if domainErr != nil || user.Registration == nil || user.DirectoryURL != t.getDirectoryURL() || user.ExternalAccountKeyID != t.getExternalAccountBinding().KeyID {
+			return nil, err
+		}
+
+		err = t.saveUser(user)
+		if err != nil {
+			return nil, err
+		}
+
+		zap.L().Info(fmt.Sprintf("Domain %s ACME account %s moved to %s to be shared with the domains using the same external account binding", t.Name, user.Registration.URI, t.getUserFile()))
+
+		return user, nil
+	}
+
+	return unmarshalUser(b)
+}
+
+// loadDomainUser loads the account from the domain cache directory
+func (t *DomainWrapper) loadDomainUser() (*User, error) {
+
+	b, err := os.ReadFile(filepath.Join(t.getCacheDir(), UserFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalUser(b)
+}
+
+func unmarshalUser(b []byte) (*User, error) {
+
+	user := &User{}
+	err := json.Unmarshal(b, user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s; %w", UserFileName, err)
+	}
+
+	if user.DirectoryURL == "" {
+		user.DirectoryURL = DefaultDirectoryURL
+	}
+
+	return user, nil
+}
+
+func (t *DomainWrapper) getUser() (*User, error) {
+
+	directoryURL := t.getDirectoryURL()
+
+	user, err := t.loadUser()
+	if err == nil {
+
+		// An account is only valid on the ACME server it was registered with
+		if user.DirectoryURL != directoryURL {
+			zap.L().Info(fmt.Sprintf("Domain %s ACME directory changed from %s to %s; a new account will be registered", t.Name, user.DirectoryURL, directoryURL))
+			user.Registration = nil
+			user.DirectoryURL = directoryURL
+		}
+
+		eab := t.getExternalAccountBinding()
+
+		if eab != nil && user.ExternalAccountKeyID != eab.KeyID {
+			zap.L().Info(fmt.Sprintf("Domain %s external account binding changed; a new account will be registered", t.Name))
+			user.Registration = nil
+		}
+
+		return user, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate account key; %w", err)
+	}
+
+	return &User{
+		Email:        t.email,
+		Key:          key,
+		DirectoryURL: directoryURL,
+	}, nil
+}
+
+func (t *DomainWrapper) saveUser(user *User) error {
+
+	b, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	userFile := t.getUserFile()
+
+	err = os.MkdirAll(filepath.Dir(userFile), CacheDirPerm)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(userFile, b, CacheDirPerm)
+}
+
+// getHTTPClient returns the lego default HTTP client trusting the CA bundle if one is set
+func (t *DomainWrapper) getHTTPClient() (*http.Client, error) {
+
+	httpClient := lego.NewConfig(nil).HTTPClient
+
+	caBundle := t.getCABundle()
+	if caBundle == "" {
+		return httpClient, nil
+	}
+
+	pool, err := loadCABundle(caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unexpected ACME client transport")
+	}
+
+	transport.TLSClientConfig.RootCAs = pool
+
+	return httpClient, nil
+}
+
+// Directory is the subset of the ACME directory that lego does not expose
+type Directory struct {
+	NewOrder    string         `json:"newOrder"`
+	RenewalInfo string         `json:"renewalInfo,omitempty"`
+	Meta        *DirectoryMeta `json:"meta,omitempty"`
+}
+
+type DirectoryMeta struct {
+	Profiles map[string]string `json:"profiles,omitempty"`
+}
+
+// getJSON gets the URL and unmarshals the JSON response into result
+func getJSON(httpClient *http.Client, url string, result any) (http.Header, error) {
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Header, json.Unmarshal(b, result)
+}
+
+func (t *DomainWrapper) getDirectory(httpClient *http.Client) (*Directory, error) {
+	directory := &Directory{}
+	_, err := getJSON(httpClient, t.getDirectoryURL(), directory)
+	if err != nil {
+		return nil, err
+	}
+	return directory, nil
+}
+
+// getCore returns the lego ACME API for the registered account. It is used for
+// the requests the lego client does not expose
+func (t *DomainWrapper) getCore() (*api.Core, error) {
+
+	user, err := t.getUser()
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Registration == nil {
+		return nil, fmt.Errorf("account is not registered")
+	}
+
+	httpClient, err := t.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return api.New(httpClient, UserAgent, t.getDirectoryURL(), user.Registration.URI, user.Key)
+}
+
+func (t *DomainWrapper) getClient() (*lego.Client, error) {
+
+	// Domains sharing an account, and the variant of a dual domain, must not
+	// register it more than once
+	t.accountMutex.Lock()
+	defer t.accountMutex.Unlock()
+
+	user, err := t.getUser()
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := t.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if profile := t.getProfile(); profile != "" {
+
+		directory, err := t.getDirectory(httpClient)
+		if err != nil {
+			return nil, err
+		}
+
+		if directory.Meta == nil || len(directory.Meta.Profiles) == 0 {
+			return nil, fmt.Errorf("ACME server does not support profiles")
+		}
+
+		if _, ok := directory.Meta.Profiles[profile]; !ok {
+			var profiles []string
+			for name := range directory.Meta.Profiles {
+				profiles = append(profiles, name)
+			}
+			sort.Strings(profiles)
+			return nil, fmt.Errorf("ACME server does not support profile %s; supported profiles are %s", profile, strings.Join(profiles, ", "))
+		}
+
+		httpClient.Transport = &profileTransport{
+			RoundTripper: httpClient.Transport,
+			newOrderURL:  directory.NewOrder,
+			profile:      profile,
+			key:          user.Key,
+		}
+	}
+
+	config := lego.NewConfig(user)
+	config.CADirURL = t.getDirectoryURL()
+	config.UserAgent = UserAgent
+	config.Certificate.KeyType = getCertcryptoKeyType(t.getKeyType())
+	config.HTTPClient = httpClient
+
+	client, err := lego.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ACME client; %w", err)
+	}
+
+	switch t.getChallengeType() {
+
+	case ChallengeTypeDNS:
+
+		provider, err := newDNSProvider(t.Challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		err = client.Challenge.SetDNS01Provider(provider,
+			dns01.CondOption(len(t.Challenge.Resolvers) > 0, dns01.AddRecursiveNameservers(dns01.ParseNameservers(t.Challenge.Resolvers))),
+			dns01.CondOption(t.Challenge.DisablePropagationCheck, dns01.DisableCompletePropagationRequirement()),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+
+		if t.Challenge != nil && t.Challenge.Webroot != "" {
+
+			provider, err := webroot.NewHTTPProvider(t.Challenge.Webroot)
+			if err != nil {
+				return nil, err
+			}
+
+			err = client.Challenge.SetHTTP01Provider(provider)
+			if err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
+		if t.Challenge != nil && t.Challenge.HTTPAddress != "" {
+
+			err = client.Challenge.SetHTTP01Provider(t.solver.httpProvider(t.Challenge.HTTPAddress))
+			if err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
+		err = client.Challenge.SetHTTP01Provider(t.solver.httpProvider(t.httpChallengeAddress))
+		if err != nil {
+			return nil, err
+		}
+
+		err = client.Challenge.SetTLSALPN01Provider(t.solver.tlsProvider(t.tlsChallengeAddress))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if user.Registration == nil {
+
+		var reg *registration.Resource
+
+		eab := t.getExternalAccountBinding()
+
+		if eab != nil {
+
+			hmacKey, err := resolveCredential(eab.HMACKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read external account binding HMAC key; %w", err)
+			}
+
+			reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  eab.KeyID,
+				HmacEncoded:          hmacKey,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to register ACME account with external account binding; %w", err)
+			}
+
+			user.ExternalAccountKeyID = eab.KeyID
+
+		} else {
+
+			if client.GetExternalAccountRequired() {
+				return nil, fmt.Errorf("ACME server %s requires an external account binding", t.getDirectoryURL())
+			}
+
+			reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+			if err != nil {
+				return nil, fmt.Errorf("failed to register ACME account; %w", err)
+			}
+		}
+
+		user.Registration = reg
+
+		err = t.saveUser(user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save ACME account; %w", err)
+		}
+
+		zap.L().Info(fmt.Sprintf("Registered ACME account for domain %s", t.Name))
+	}
+
+	return client, nil
+}
+
+// obtain requests a new certificate for the domain and its aliases and writes it to the cache
+func (t *DomainWrapper) obtain() (*CR, []*Chain, error) {
+
+	if logger.Trace {
+		zap.L().Debug(fmt.Sprintf("Obtaining certificate for domain %s", t.Name))
+	}
+
+	client, err := t.getClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resource, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains:        t.getDomains(),
+		Bundle:         true,
+		PreferredChain: t.Domain.PreferredChain,
+		MustStaple:     t.getMustStaple(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to obtain certificate; %w", err)
+	}
+
+	cr := &CR{
+		Domain:            resource.Domain,
+		CertURL:           resource.CertURL,
+		CertStableURL:     resource.CertStableURL,
+		PrivateKey:        resource.PrivateKey,
+		Certificate:       resource.Certificate,
+		IssuerCertificate: resource.IssuerCertificate,
+		CSR:               resource.CSR,
+	}
+
+	err = t.saveCR(cr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write certificate to cache; %w", err)
+	}
+
+	chains := t.getChains(cr)
+
+	err = t.saveChains(chains)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write chains to cache; %w", err)
+	}
+
+	return cr, chains, nil
+}
+
+func (t *DomainWrapper) saveCR(cr *CR) error {
+
+	certDir := t.getCertDir()
+
+	b, err := json.MarshalIndent(cr, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(certDir, CertResourceFileName), b, CacheDirPerm)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(certDir, CertPemFileName), cr.Certificate, CacheDirPerm)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(certDir, KeyPemFileName), cr.PrivateKey, CacheDirPerm)
+}
+
+func (t *DomainWrapper) loadCR() (*CR, error) {
+
+	b, err := os.ReadFile(filepath.Join(t.getCertDir(), CertResourceFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &CR{}
+	err = json.Unmarshal(b, cr)
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// domainsChanged returns true if the names on the certificate differ from the configured names
+func (t *DomainWrapper) domainsChanged(x509Cert *x509.Certificate) bool {
+
+	have := certcrypto.ExtractDomains(x509Cert)
+	want := t.getDomains()
+
+	if len(have) != len(want) {
+		return true
+	}
+
+	sort.Strings(have)
+	sort.Strings(want)
+
+	for i := range have {
+		if !strings.EqualFold(have[i], want[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCertificate(cr *CR) (*x509.Certificate, error) {
+
+	block, _ := pem.Decode(cr.Certificate)
+	if block == nil {
+		return nil, fmt.Errorf("certificate is not PEM encoded")
+	}
+
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if x509Cert.IsCA {
+		return nil, fmt.Errorf("certificate bundle starts with a CA certificate")
+	}
+
+	return x509Cert, nil
+}
+
+// resolveCredential returns the credential value. The value may reference a file
+// with the prefix file: or an environment variable with the prefix env:
+func resolveCredential(value string) (string, error) {
+
+	switch {
+
+	case strings.HasPrefix(value, CredentialPrefixFile):
+		b, err := os.ReadFile(strings.TrimPrefix(value, CredentialPrefixFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+
+	case strings.HasPrefix(value, CredentialPrefixEnv):
+		return os.Getenv(strings.TrimPrefix(value, CredentialPrefixEnv)), nil
+
+	}
+
+	return value, nil
+}
+
+// dnsProviders are DNS providers used instead of the lego provider with the
+// same name. The provider is created with the resolved challenge credentials
+var dnsProviders = map[string]func(credentials map[string]string) (challenge.Provider, error){}
+
+// newDNSProvider creates the named lego DNS provider with the challenge credentials
+// set in the environment. Credential values are resolved with resolveCredential
+func newDNSProvider(c *Challenge) (challenge.Provider, error) {
+
+	if c.Provider == "" {
+		return nil, fmt.Errorf("challenge provider is required for %s", string(ChallengeTypeDNS))
+	}
+
+	credentials := make(map[string]string)
+
+	for name, value := range c.Credentials {
+		credential, err := resolveCredential(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credential %s; %w", name, err)
+		}
+		credentials[name] = credential
+	}
+
+	if newProvider, ok := dnsProviders[c.Provider]; ok {
+		return newProvider(credentials)
+	}
+
+	envMutex.Lock()
+	defer envMutex.Unlock()
+
+	for name, value := range credentials {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	provider, err := dns.NewDNSChallengeProviderByName(c.Provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DNS provider %s; %w", c.Provider, err)
+	}
+
+	return provider, nil
+}
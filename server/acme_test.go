@@ -0,0 +1,159 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+func TestValidateDomainName(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "example.com", valid: true},
+		{name: "www.example.com", valid: true},
+		{name: "*.example.com", valid: true},
+		{name: "*.internal.example.com", valid: true},
+		{name: ""},
+		{name: "example..com"},
+		{name: ".example.com"},
+		{name: "example.com."},
+		{name: "*.com"},
+		{name: "*"},
+		{name: "www.*.example.com"},
+		{name: "*www.example.com"},
+		{name: "w*.example.com"},
+		{name: "**.example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			err := validateDomainName(test.name)
+
+			if test.valid && err != nil {
+				t.Fatalf("expected %s to be valid; %s", test.name, err)
+			}
+
+			if !test.valid && err == nil {
+				t.Fatalf("expected %s to be invalid", test.name)
+			}
+		})
+	}
+}
+
+func TestMatchDomainName(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{pattern: "example.com", name: "example.com", match: true},
+		{pattern: "example.com", name: "EXAMPLE.com", match: true},
+		{pattern: "example.com", name: "www.example.com"},
+		{pattern: "*.example.com", name: "www.example.com", match: true},
+		{pattern: "*.example.com", name: "WWW.Example.COM", match: true},
+		{pattern: "*.example.com", name: "*.example.com", match: true},
+		{pattern: "*.example.com", name: "example.com"},
+		{pattern: "*.example.com", name: "a.b.example.com"},
+		{pattern: "*.example.com", name: "www.example.org"},
+		{pattern: "*.example.com", name: ".example.com"},
+		{pattern: "*.example.com", name: "wwwexample.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.name, func(t *testing.T) {
+			if matchDomainName(test.pattern, test.name) != test.match {
+				t.Fatalf("expected match %t", test.match)
+			}
+		})
+	}
+}
+
+func TestAddressesConflict(t *testing.T) {
+
+	tests := []struct {
+		a        string
+		b        string
+		conflict bool
+	}{
+		{a: ":80", b: ":80", conflict: true},
+		{a: ":80", b: ":443"},
+		{a: ":80", b: "127.0.0.1:80", conflict: true},
+		{a: "0.0.0.0:80", b: "127.0.0.1:80", conflict: true},
+		{a: "[::]:80", b: "[::1]:80", conflict: true},
+		{a: "127.0.0.1:80", b: "127.0.0.1:80", conflict: true},
+		{a: "127.0.0.1:80", b: "127.0.0.2:80"},
+		{a: "localhost:80", b: "LOCALHOST:80", conflict: true},
+		{a: "[::1]:8443", b: "127.0.0.1:8443"},
+		{a: "invalid", b: ":80"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.a+" "+test.b, func(t *testing.T) {
+
+			if addressesConflict(test.a, test.b) != test.conflict {
+				t.Fatalf("expected conflict %t", test.conflict)
+			}
+
+			if addressesConflict(test.b, test.a) != test.conflict {
+				t.Fatalf("expected conflict %t with the addresses swapped", test.conflict)
+			}
+		})
+	}
+}
+
+type testDNSProvider struct {
+	credentials map[string]string
+}
+
+func (t *testDNSProvider) Present(domain, token, keyAuth string) error {
+	return nil
+}
+
+func (t *testDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func TestNewDNSProvider(t *testing.T) {
+
+	dnsProviders["test"] = func(credentials map[string]string) (challenge.Provider, error) {
+		return &testDNSProvider{credentials: credentials}, nil
+	}
+
+	t.Cleanup(func() {
+		delete(dnsProviders, "test")
+	})
+
+	t.Setenv("TEST_DNS_TOKEN", "token")
+
+	c := &Challenge{Type: string(ChallengeTypeDNS), Provider: "test"}
+	c.AddCredential("TEST_DNS_API_TOKEN", "env:TEST_DNS_TOKEN")
+
+	provider, err := newDNSProvider(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testProvider, ok := provider.(*testDNSProvider)
+	if !ok {
+		t.Fatalf("expected the registered provider, got %T", provider)
+	}
+
+	if testProvider.credentials["TEST_DNS_API_TOKEN"] != "token" {
+		t.Fatalf("expected the resolved credential, got %v", testProvider.credentials)
+	}
+
+	_, err = newDNSProvider(&Challenge{Type: string(ChallengeTypeDNS)})
+	if err == nil {
+		t.Fatal("expected an error without a provider")
+	}
+
+	_, err = newDNSProvider(&Challenge{Type: string(ChallengeTypeDNS), Provider: "unknown"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown provider")
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	logger "github.com/jodydadescott/jody-go-logger"
+	"go.uber.org/zap"
+)
+
+// RenewalInfo is the ACME Renewal Information (RFC 9773) for a certificate
+type RenewalInfo struct {
+	SuggestedWindow *RenewalWindow `json:"suggestedWindow,omitempty"`
+	ExplanationURL  string         `json:"explanationURL,omitempty"`
+	// RetryAfter is how long the server asks us to wait before polling again
+	RetryAfter time.Duration `json:"-"`
+}
+
+type RenewalWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// getRenewalTime returns a random time within the suggested window
+func (t *RenewalInfo) getRenewalTime() time.Time {
+
+	window := t.SuggestedWindow.End.Sub(t.SuggestedWindow.Start)
+	if window <= 0 {
+		return t.SuggestedWindow.Start
+	}
+
+	return t.SuggestedWindow.Start.Add(time.Duration(rand.Int63n(int64(window))))
+}
+
+// getARICertID returns the ARI certificate identifier. This is the base64url
+// encoded authority key identifier and the base64url encoded DER serial number
+// joined by a period
+func getARICertID(x509Cert *x509.Certificate) (string, error) {
+
+	if len(x509Cert.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("certificate does not have an authority key identifier")
+	}
+
+	serial := x509Cert.SerialNumber.Bytes()
+
+	// The DER encoding of a positive integer has a leading zero if the high bit is set
+	if len(serial) > 0 && serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(x509Cert.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// getRenewalInfo returns the ARI for the certificate. If the ACME server does not
+// support ARI then nil is returned without an error
+func (t *DomainWrapper) getRenewalInfo(x509Cert *x509.Certificate) (*RenewalInfo, error) {
+
+	httpClient, err := t.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	directory, err := t.getDirectory(httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	if directory.RenewalInfo == "" {
+		return nil, nil
+	}
+
+	certID, err := getARICertID(x509Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	renewalInfo := &RenewalInfo{}
+
+	header, err := getJSON(httpClient, strings.TrimSuffix(directory.RenewalInfo, "/")+"/"+certID, renewalInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if renewalInfo.SuggestedWindow == nil {
+		return nil, fmt.Errorf("renewal information does not have a suggested window")
+	}
+
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds > 0 {
+		renewalInfo.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	return renewalInfo, nil
+}
+
+// checkRenewalInfo fetches the ARI for the certificate and returns the reason to
+// renew if the renewal time chosen within the suggested window has passed. A
+// new renewal time is only chosen when the suggested window changes
+func (t *DomainWrapper) checkRenewalInfo(x509Cert *x509.Certificate) string {
+
+	renewalInfo, err := t.getRenewalInfo(x509Cert)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("Domain %s failed to get renewal information; error %s", t.Name, err.Error()))
+		return ""
+	}
+
+	if renewalInfo == nil {
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("Domain %s ACME server does not support renewal information", t.Name))
+		}
+		return ""
+	}
+
+	t.Lock()
+
+	if t.renewalInfo == nil || !t.renewalInfo.SuggestedWindow.Start.Equal(renewalInfo.SuggestedWindow.Start) || !t.renewalInfo.SuggestedWindow.End.Equal(renewalInfo.SuggestedWindow.End) {
+		t.renewalTime = renewalInfo.getRenewalTime()
+		zap.L().Info(fmt.Sprintf("Domain %s suggested renewal window is %s to %s; renewal time is %s", t.Name,
+			renewalInfo.SuggestedWindow.Start.Format(time.RFC3339), renewalInfo.SuggestedWindow.End.Format(time.RFC3339), t.renewalTime.Format(time.RFC3339)))
+	}
+
+	t.renewalInfo = renewalInfo
+	renewalTime := t.renewalTime
+
+	t.Unlock()
+
+	if time.Now().Before(renewalTime) {
+		return ""
+	}
+
+	reason := fmt.Sprintf("ACME renewal information suggested window %s to %s", renewalInfo.SuggestedWindow.Start.Format(time.RFC3339), renewalInfo.SuggestedWindow.End.Format(time.RFC3339))
+
+	if renewalInfo.ExplanationURL != "" {
+		reason = reason + "; explanation " + renewalInfo.ExplanationURL
+	}
+
+	return reason
+}
+
+// getRenewalInfoDelay returns the delay shortened to the ARI renewal time or the
+// ARI Retry-After if either is sooner. A renewal time that has passed does not
+// shorten the delay so a failed renewal is retried with its backoff, and a
+// renewal deferred by a rate limit is not checked before the limit allows it
+func (t *DomainWrapper) getRenewalInfoDelay(delay time.Duration) time.Duration {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.renewalInfo == nil {
+		return delay
+	}
+
+	var rateLimitErr *RateLimitError
+	if errors.As(t.err, &rateLimitErr) {
+		return delay
+	}
+
+	if t.renewalInfo.RetryAfter > 0 && t.renewalInfo.RetryAfter < delay {
+		delay = t.renewalInfo.RetryAfter
+	}
+
+	if !t.renewalTime.IsZero() {
+		until := time.Until(t.renewalTime)
+		if until > 0 && until < delay {
+			delay = until
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetRenewalInfoDelay(t *testing.T) {
+
+	window := &RenewalWindow{
+		Start: time.Now().Add(-2 * time.Hour),
+		End:   time.Now().Add(time.Hour),
+	}
+
+	rateLimitErr := &RateLimitError{
+		Limit:   RateLimitFailedValidations,
+		RetryAt: time.Now().Add(3 * time.Hour),
+	}
+
+	tests := []struct {
+		name        string
+		renewalTime time.Time
+		retryAfter  time.Duration
+		err         error
+		want        time.Duration
+	}{
+		{
+			name:        "failed renewal after the renewal time is retried with its backoff",
+			renewalTime: time.Now().Add(-time.Hour),
+			err:         errors.New("failed to obtain certificate"),
+			want:        DefaultRetryInterval,
+		},
+		{
+			name:        "rate limited renewal after the renewal time waits for the limit",
+			renewalTime: time.Now().Add(-time.Hour),
+			retryAfter:  time.Minute,
+			err:         rateLimitErr,
+			want:        3 * time.Hour,
+		},
+		{
+			name:        "renewal time is sooner",
+			renewalTime: time.Now().Add(2 * time.Hour),
+			want:        2 * time.Hour,
+		},
+		{
+			name:        "retry after is sooner",
+			renewalTime: time.Now().Add(2 * time.Hour),
+			retryAfter:  time.Hour,
+			want:        time.Hour,
+		},
+		{
+			name:        "check interval is sooner",
+			renewalTime: time.Now().Add(30 * 24 * time.Hour),
+			want:        DefaultCheckInterval,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			domain := &DomainWrapper{
+				Domain: &Domain{Name: "example.com"},
+				Server: &Server{
+					checkInterval: DefaultCheckInterval,
+					retryInterval: DefaultRetryInterval,
+				},
+				renewalInfo: &RenewalInfo{SuggestedWindow: window, RetryAfter: test.retryAfter},
+				renewalTime: test.renewalTime,
+			}
+
+			delay := DefaultCheckInterval
+			if test.err != nil {
+				domain.setErr(test.err)
+				delay = domain.getNextDelay(test.err)
+			}
+
+			delay = domain.getRenewalInfoDelay(delay)
+
+			if delay <= 0 {
+				t.Fatal("expected a delay")
+			}
+
+			if delay > test.want || delay < test.want-time.Minute {
+				t.Fatalf("expected delay %s, got %s", test.want, delay)
+			}
+		})
+	}
+}
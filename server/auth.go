@@ -0,0 +1,426 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+// authToken is a token issued by /getauthtoken for an auth secret
+type authToken struct {
+	*Token
+	*authSecret
+}
+
+// isValidFor returns true if the token is valid for the domain name
+func (t *authToken) isValidFor(name string) bool {
+	for _, domain := range t.domains {
+		if domain == name {
+			return true
+		}
+	}
+	return false
+}
+
+// authSecret is a secret and the domains a token issued for it is valid for.
+// Identity is the name of the client identity the secret belongs to or empty
+// for the admin, global and domain secrets. Only a token issued for the admin
+// secret or an admin identity is valid for the admin requests
+type authSecret struct {
+	identity           string
+	global             bool
+	secret             string
+	certificateSubject string
+	certificateSPKI    string
+	domains            []string
+	admin              bool
+	expires            time.Time
+	revoked            bool
+}
+
+// getName returns the name logged for the secret
+func (t *authSecret) getName() string {
+	switch {
+	case t.identity != "":
+		return t.identity
+	case t.admin:
+		return "admin secret"
+	case t.global:
+		return "global secret"
+	}
+	return "domain secret"
+}
+
+// validate returns an error if the secret is revoked or expired. The caller must
+// hold the auth server lock
+func (t *authSecret) validate() error {
+
+	if t.revoked {
+		return fmt.Errorf("identity %s is revoked", t.identity)
+	}
+
+	if !t.expires.IsZero() && time.Now().After(t.expires) {
+		return fmt.Errorf("identity %s is expired", t.identity)
+	}
+
+	return nil
+}
+
+// authServer issues nonces for auth requests and tokens for auth requests
+// hashed with the admin secret, the global secret, a domain secret or the
+// secret of a client identity. A domain with a secret is only valid for tokens
+// issued for that secret; the other domains are valid for tokens issued for the
+// global secret. A request for an identity is only checked against the identity
+// secret. Nonces are single use
+type authServer struct {
+	mutex      sync.Mutex
+	secrets    []*authSecret
+	identities map[string]*authSecret
+	nonces     map[string]time.Time
+	tokens     map[string]*authToken
+}
+
+// newAuthServer returns the auth server for the secrets. The admin secret must
+// differ from the global and domain secrets
+func newAuthServer(secret string, adminSecret string, domains []*DomainWrapper) *authServer {
+
+	t := &authServer{
+		identities: make(map[string]*authSecret),
+		nonces:     make(map[string]time.Time),
+		tokens:     make(map[string]*authToken),
+	}
+
+	bySecret := make(map[string]*authSecret)
+
+	getSecret := func(secret string) *authSecret {
+		s := bySecret[secret]
+		if s == nil {
+			s = &authSecret{secret: secret}
+			bySecret[secret] = s
+			t.secrets = append(t.secrets, s)
+		}
+		return s
+	}
+
+	if secret != "" {
+		getSecret(secret).global = true
+	}
+
+	for _, domain := range domains {
+		// A domain without a secret is only valid for client identities
+		if domain.getSecret() == "" {
+			continue
+		}
+		s := getSecret(domain.getSecret())
+		s.domains = append(s.domains, domain.Name)
+	}
+
+	for _, s := range t.secrets {
+		sort.Strings(s.domains)
+	}
+
+	// The admin secret is not valid for any domain so it is not needed by clients
+	if adminSecret != "" {
+		t.secrets = append(t.secrets, &authSecret{secret: adminSecret, admin: true})
+	}
+
+	return t
+}
+
+// randomString returns a random base64url string of n bytes
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// expire removes the expired nonces and tokens. The caller must hold the lock
+func (t *authServer) expire() {
+
+	now := time.Now()
+
+	for nonce, exp := range t.nonces {
+		if now.After(exp) {
+			delete(t.nonces, nonce)
+		}
+	}
+
+	for key, token := range t.tokens {
+		if now.Unix() > token.Exp {
+			delete(t.tokens, key)
+		}
+	}
+}
+
+func (t *authServer) newRequest() *AuthRequest {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.expire()
+
+	nonce := randomString(AuthNonceSize)
+	t.nonces[nonce] = time.Now().Add(AuthNonceLife)
+
+	return &AuthRequest{
+		ServerNonce: nonce,
+	}
+}
+
+// getTokenFromRequest returns a token for the secret the request was hashed
+// with. If identity is set the request must be hashed with the identity secret.
+// The server nonce is consumed whether or not the hash matches
+func (t *authServer) getTokenFromRequest(request *AuthRequest, identity string) (*authToken, error) {
+
+	if request == nil {
+		return nil, fmt.Errorf("auth request is nil")
+	}
+
+	if request.ServerNonce == "" {
+		return nil, fmt.Errorf("request is missing ServerNonce")
+	}
+
+	if request.ClientNonce == "" {
+		return nil, fmt.Errorf("request %s ClientNonce is empty", request.ServerNonce)
+	}
+
+	if request.Hash == "" {
+		return nil, fmt.Errorf("request %s Hash is empty", request.ServerNonce)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	exp, ok := t.nonces[request.ServerNonce]
+	delete(t.nonces, request.ServerNonce)
+
+	if !ok || time.Now().After(exp) {
+		return nil, fmt.Errorf("request %s ServerNonce not found", request.ServerNonce)
+	}
+
+	secrets := t.secrets
+
+	if identity != "" {
+		s := t.identities[identity]
+		if s == nil {
+			return nil, fmt.Errorf("request %s failed hash", request.ServerNonce)
+		}
+		secrets = []*authSecret{s}
+	}
+
+	for _, s := range secrets {
+
+		// An identity that only has a certificate does not have a secret
+		if s.secret == "" {
+			continue
+		}
+
+		expectedHash := request.GetHashFromSecret(s.secret)
+
+		if subtle.ConstantTimeCompare([]byte(request.Hash), []byte(expectedHash)) == 1 {
+
+			err := s.validate()
+			if err != nil {
+				return nil, err
+			}
+
+			token := &authToken{
+				Token: &Token{
+					Token: randomString(AuthTokenSize),
+					Exp:   time.Now().Add(AuthTokenLife).Unix(),
+				},
+				authSecret: s,
+			}
+
+			t.tokens[token.Token.Token] = token
+
+			return token, nil
+		}
+	}
+
+	return nil, fmt.Errorf("request %s failed hash", request.ServerNonce)
+}
+
+// getTokenFromCertificate returns a token for the identity the client
+// certificate maps to. The certificate maps to an identity by its SPKI hash or,
+// if verified is true, by its subject. An SPKI match is preferred over a match
+// of the subject distinguished name, which is preferred over a match of the
+// subject common name. The token is only valid for the request the certificate
+// was presented with and is not kept
+func (t *authServer) getTokenFromCertificate(x509Cert *x509.Certificate, verified bool) (*authToken, error) {
+
+	spki := types.GetSPKIHash(x509Cert)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var match, subjectMatch, commonNameMatch *authSecret
+
+	// The identities have unique SPKI hashes and subjects so there is at most
+	// one match of each kind
+	for _, s := range t.identities {
+
+		if s.certificateSPKI != "" && s.certificateSPKI == spki {
+			match = s
+			break
+		}
+
+		if !verified || s.certificateSubject == "" {
+			continue
+		}
+
+		switch s.certificateSubject {
+
+		case x509Cert.Subject.String():
+			subjectMatch = s
+
+		case x509Cert.Subject.CommonName:
+			commonNameMatch = s
+
+		}
+	}
+
+	if match == nil {
+		match = subjectMatch
+	}
+
+	if match == nil {
+		match = commonNameMatch
+	}
+
+	if match == nil {
+		if !verified {
+			return nil, fmt.Errorf("client certificate %s is not verified and its SPKI %s does not match an identity", x509Cert.Subject.String(), spki)
+		}
+		return nil, fmt.Errorf("client certificate %s does not match an identity", x509Cert.Subject.String())
+	}
+
+	err := match.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &authToken{authSecret: match}, nil
+}
+
+// validateToken returns the token for the key if it exists, is not expired and
+// its identity is still valid
+func (t *authServer) validateToken(key string) (*authToken, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	token := t.tokens[key]
+	if token == nil || time.Now().Unix() > token.Exp {
+		return nil, fmt.Errorf("Unauthorized")
+	}
+
+	err := token.validate()
+	if err != nil {
+		delete(t.tokens, key)
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// hasIdentity returns true if the client identity exists
+func (t *authServer) hasIdentity(identity string) bool {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, exist := t.identities[identity]
+	return exist
+}
+
+// setIdentity adds or replaces the secret of a client identity. Tokens issued
+// for a replaced secret are removed
+func (t *authServer) setIdentity(s *authSecret) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.removeTokens(s.identity)
+	t.identities[s.identity] = s
+}
+
+// removeIdentity removes the secret of a client identity and its tokens
+func (t *authServer) removeIdentity(identity string) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.removeTokens(identity)
+	delete(t.identities, identity)
+}
+
+// revokeIdentity revokes the secret of a client identity and removes its tokens
+func (t *authServer) revokeIdentity(identity string) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.removeTokens(identity)
+	if s := t.identities[identity]; s != nil {
+		s.revoked = true
+	}
+}
+
+// removeTokens removes the tokens issued to the identity. The caller must hold the lock
+func (t *authServer) removeTokens(identity string) {
+	for key, token := range t.tokens {
+		if token.identity == identity {
+			delete(t.tokens, key)
+		}
+	}
+}
+
+// getSecret returns the domain secret or the global secret if it is not set
+func (t *DomainWrapper) getSecret() string {
+	if t.Domain.Secret != "" {
+		return t.Domain.Secret
+	}
+	return t.Server.secret
+}
+
+// getTokenFromClientCertificate returns a token for the identity the client
+// certificate chain maps to. The chain is verified against the client CA if
+// it is set
+func (t *Server) getTokenFromClientCertificate(chain []*x509.Certificate) (*authToken, error) {
+
+	x509Cert := chain[0]
+
+	verified := false
+
+	if t.clientCAs != nil {
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := x509Cert.Verify(x509.VerifyOptions{
+			Roots:         t.clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+
+		if err == nil {
+			verified = true
+		} else {
+			zap.L().Debug(fmt.Sprintf("Client certificate %s is not verified by the client CA; %s", x509Cert.Subject.String(), err.Error()))
+		}
+	}
+
+	return t.auth.getTokenFromCertificate(x509Cert, verified)
+}
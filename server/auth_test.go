@@ -0,0 +1,304 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+// newTestCertificate returns a self signed client certificate for the subject
+func newTestCertificate(t *testing.T, subject pkix.Name) *x509.Certificate {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x509Cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return x509Cert
+}
+
+func TestGetTokenFromCertificate(t *testing.T) {
+
+	x509Cert := newTestCertificate(t, pkix.Name{CommonName: "nas", Organization: []string{"home"}})
+
+	tests := []struct {
+		name       string
+		identities []*authSecret
+		verified   bool
+		want       string
+	}{
+		{
+			name: "spki preferred over subject",
+			identities: []*authSecret{
+				{identity: "dn", certificateSubject: x509Cert.Subject.String()},
+				{identity: "spki", certificateSPKI: types.GetSPKIHash(x509Cert)},
+			},
+			verified: true,
+			want:     "spki",
+		},
+		{
+			name: "distinguished name preferred over common name",
+			identities: []*authSecret{
+				{identity: "cn", certificateSubject: "nas"},
+				{identity: "dn", certificateSubject: x509Cert.Subject.String()},
+			},
+			verified: true,
+			want:     "dn",
+		},
+		{
+			name: "common name",
+			identities: []*authSecret{
+				{identity: "cn", certificateSubject: "nas"},
+				{identity: "other", certificateSubject: "other"},
+			},
+			verified: true,
+			want:     "cn",
+		},
+		{
+			name: "subject requires a verified certificate",
+			identities: []*authSecret{
+				{identity: "cn", certificateSubject: "nas"},
+			},
+			verified: false,
+		},
+		{
+			name: "spki does not require a verified certificate",
+			identities: []*authSecret{
+				{identity: "spki", certificateSPKI: types.GetSPKIHash(x509Cert)},
+			},
+			verified: false,
+			want:     "spki",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			// Each match is repeated as map iteration order varies
+			for i := 0; i < 20; i++ {
+
+				auth := newAuthServer("", "", nil)
+				for _, s := range test.identities {
+					auth.setIdentity(s)
+				}
+
+				token, err := auth.getTokenFromCertificate(x509Cert, test.verified)
+
+				if test.want == "" {
+					if err == nil {
+						t.Fatalf("expected an error, got identity %s", token.identity)
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if token.identity != test.want {
+					t.Fatalf("expected identity %s, got %s", test.want, token.identity)
+				}
+			}
+		})
+	}
+}
+
+// getTestToken requests a token from the auth server hashed with the secret
+func getTestToken(auth *authServer, secret string, identity string) (*authToken, error) {
+
+	request := auth.newRequest()
+	request.ClientNonce = randomString(AuthNonceSize)
+	request.Hash = request.GetHashFromSecret(secret)
+
+	return auth.getTokenFromRequest(request, identity)
+}
+
+func TestTokenScope(t *testing.T) {
+
+	newDomains := func(server *Server, secrets map[string]string) []*DomainWrapper {
+		var domains []*DomainWrapper
+		for _, name := range []string{"a.com", "b.com", "c.com", "d.com"} {
+			domains = append(domains, &DomainWrapper{
+				Domain: &Domain{Name: name, Secret: secrets[name]},
+				Server: server,
+			})
+		}
+		return domains
+	}
+
+	domainSecrets := map[string]string{
+		"b.com": "b secret",
+		"c.com": "b secret",
+		"d.com": "d secret",
+	}
+
+	tests := []struct {
+		name    string
+		global  string
+		secret  string
+		valid   []string
+		invalid []string
+		admin   bool
+		fail    bool
+	}{
+		{
+			name:    "global secret is valid for the domains without a secret",
+			global:  "global secret",
+			secret:  "global secret",
+			valid:   []string{"a.com"},
+			invalid: []string{"b.com", "c.com", "d.com"},
+		},
+		{
+			name:    "domain secret is only valid for its domains",
+			global:  "global secret",
+			secret:  "b secret",
+			valid:   []string{"b.com", "c.com"},
+			invalid: []string{"a.com", "d.com"},
+		},
+		{
+			name:    "another domain secret",
+			global:  "global secret",
+			secret:  "d secret",
+			valid:   []string{"d.com"},
+			invalid: []string{"a.com", "b.com", "c.com"},
+		},
+		{
+			name:    "admin secret is only valid for the admin requests",
+			global:  "global secret",
+			secret:  "admin secret",
+			invalid: []string{"a.com", "b.com", "c.com", "d.com"},
+			admin:   true,
+		},
+		{
+			name:   "unknown secret",
+			global: "global secret",
+			secret: "wrong secret",
+			fail:   true,
+		},
+		{
+			name:    "domain without a secret is not valid without the global secret",
+			secret:  "b secret",
+			valid:   []string{"b.com", "c.com"},
+			invalid: []string{"a.com", "d.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			server := &Server{secret: test.global}
+			auth := newAuthServer(test.global, "admin secret", newDomains(server, domainSecrets))
+
+			token, err := getTestToken(auth, test.secret, "")
+
+			if test.fail {
+				if err == nil {
+					t.Fatalf("expected an error, got a token for %v", token.domains)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if token.admin != test.admin {
+				t.Fatalf("expected admin %t, got %t", test.admin, token.admin)
+			}
+
+			for _, name := range test.valid {
+				if !token.isValidFor(name) {
+					t.Errorf("expected token to be valid for %s", name)
+				}
+			}
+
+			for _, name := range test.invalid {
+				if token.isValidFor(name) {
+					t.Errorf("expected token to not be valid for %s", name)
+				}
+			}
+
+			validated, err := auth.validateToken(token.Token.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if validated != token {
+				t.Fatal("expected the validated token to be the issued token")
+			}
+		})
+	}
+}
+
+func TestTokenRequest(t *testing.T) {
+
+	auth := newAuthServer("global secret", "", nil)
+	auth.setIdentity(&authSecret{identity: "pi", secret: "pi secret", domains: []string{"a.com"}})
+
+	request := auth.newRequest()
+	request.ClientNonce = randomString(AuthNonceSize)
+	request.Hash = request.GetHashFromSecret("global secret")
+
+	_, err := auth.getTokenFromRequest(request, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = auth.getTokenFromRequest(request, "")
+	if err == nil {
+		t.Fatal("expected the server nonce to be single use")
+	}
+
+	_, err = getTestToken(auth, "global secret", "pi")
+	if err == nil {
+		t.Fatal("expected an identity request to only be checked against the identity secret")
+	}
+
+	token, err := getTestToken(auth, "pi secret", "pi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !token.isValidFor("a.com") || token.admin {
+		t.Fatalf("expected identity token valid for a.com only, got %v admin %t", token.domains, token.admin)
+	}
+
+	auth.revokeIdentity("pi")
+
+	_, err = auth.validateToken(token.Token.Token)
+	if err == nil {
+		t.Fatal("expected the token of a revoked identity to be removed")
+	}
+
+	_, err = getTestToken(auth, "pi secret", "pi")
+	if err == nil {
+		t.Fatal("expected a revoked identity to be refused a token")
+	}
+}
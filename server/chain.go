@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+// downloadChains downloads the default and alternate certificate chains offered
+// by the CA for the certificate
+func (t *DomainWrapper) downloadChains(cr *CR) ([]*Chain, error) {
+
+	core, err := t.getCore()
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := core.Certificates.GetAll(cr.CertURL, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var chains []*Chain
+
+	for _, cert := range certs {
+		chains = append(chains, &Chain{
+			Name:              types.GetChainName(cert.Issuer),
+			Certificate:       cert.Cert,
+			IssuerCertificate: cert.Issuer,
+		})
+	}
+
+	sort.Slice(chains, func(i, j int) bool {
+		return chains[i].Name < chains[j].Name
+	})
+
+	return chains, nil
+}
+
+// getChains returns the chains for the certificate. If the alternate chains can
+// not be downloaded only the chain of the certificate is returned
+func (t *DomainWrapper) getChains(cr *CR) []*Chain {
+
+	chains, err := t.downloadChains(cr)
+	if err == nil {
+		return chains
+	}
+
+	zap.L().Warn(fmt.Sprintf("Domain %s failed to download alternate chains; error %s", t.Name, err.Error()))
+
+	return []*Chain{{
+		Name:              types.GetChainName(cr.IssuerCertificate),
+		Certificate:       cr.Certificate,
+		IssuerCertificate: cr.IssuerCertificate,
+	}}
+}
+
+func (t *DomainWrapper) saveChains(chains []*Chain) error {
+
+	b, err := json.MarshalIndent(chains, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(t.getCertDir(), ChainsFileName), b, CacheDirPerm)
+}
+
+func (t *DomainWrapper) loadChains() ([]*Chain, error) {
+
+	b, err := os.ReadFile(filepath.Join(t.getCertDir(), ChainsFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var chains []*Chain
+	err = json.Unmarshal(b, &chains)
+	if err != nil {
+		return nil, err
+	}
+
+	return chains, nil
+}
+
+// getChain returns the certificate with the named chain
+func (t *DomainWrapper) getChain(name string) (*CR, error) {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.cr == nil {
+		return nil, fmt.Errorf("domain %s does not have a certificate", t.Name)
+	}
+
+	for _, chain := range t.chains {
+		if chain.Name == name {
+			return &CR{
+				Domain:            t.cr.Domain,
+				CertURL:           t.cr.CertURL,
+				CertStableURL:     t.cr.CertStableURL,
+				PrivateKey:        t.cr.PrivateKey,
+				Certificate:       chain.Certificate,
+				IssuerCertificate: chain.IssuerCertificate,
+				CSR:               t.cr.CSR,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("domain %s does not have chain %s; available chains are %v", t.Name, name, t.getChainNames())
+}
+
+// getChainNames returns the names of the available chains. The caller must hold the lock
+func (t *DomainWrapper) getChainNames() []string {
+	var names []string
+	for _, chain := range t.chains {
+		names = append(names, chain.Name)
+	}
+	return names
+}
+
+// getAvailableChains returns the names of the available chains
+func (t *DomainWrapper) getAvailableChains() []string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.getChainNames()
+}
@@ -1,9 +1,101 @@
 package server
 
+import (
+	"os"
+	"time"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
 const (
 	CertResourceFileName = "CertResource.json"
+	ChainsFileName       = "Chains.json"
+	LedgerFileName       = "Ledger.json"
+	IdentitiesFileName   = "Identities.json"
+	OCSPFileName         = "ocsp.der"
+	UserFileName         = "SSLUser.json"
+	AccountsDirName      = "accounts"
 	PrefixBearer         = "Bearer "
 	CertPemFileName      = "cert.pem"
 	KeyPemFileName       = "key.pem"
 	DefaultCacheDir      = "letsencrypt"
+	UserAgent            = "home-simplecert"
+	CacheDirPerm         = os.FileMode(0700)
+
+	DirectoryProduction         = "production"
+	DirectoryStaging            = "staging"
+	DirectoryURLProduction      = "https://acme-v02.api.letsencrypt.org/directory"
+	DirectoryURLStaging         = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	DefaultDirectoryURL         = DirectoryURLProduction
+	DefaultKeyType              = types.KeyTypeRSA2048
+	DefaultRSAKeyType           = types.KeyTypeRSA2048
+	DefaultECDSAKeyType         = types.KeyTypeEC256
+	DefaultListenAddress        = ":443"
+	DefaultHTTPChallengeAddress = ":80"
+	DefaultTLSChallengeAddress  = ":443"
+
+	DefaultRenewBefore   = 30 * 24 * time.Hour
+	DefaultRenewRatio    = 1.0 / 3
+	DefaultCheckInterval = 2 * 24 * time.Hour
+	DefaultJitter        = time.Hour
+	DefaultOCSPInterval  = 12 * time.Hour
+	DefaultRetryInterval = time.Minute
+	DefaultInitWorkers   = 4
+
+	AuthNonceSize  = 48
+	AuthNonceLife  = 30 * time.Second
+	AuthTokenSize  = 96
+	AuthTokenLife  = 30 * time.Second
+	AuthSecretSize = 32
+
+	DefaultAuthRequests         = 30
+	DefaultAuthIdentityRequests = 10
+	DefaultAuthWindow           = time.Minute
+	DefaultAuthLockout          = 5 * time.Second
+	DefaultAuthMaxLockout       = time.Hour
+
+	DefaultEnrollmentLife = time.Hour
+	MaxEnrollmentLife     = 7 * 24 * time.Hour
+
+	DefaultCertificatesPerDomain       = 50
+	DefaultCertificatesPerDomainWindow = 7 * 24 * time.Hour
+	DefaultDuplicateCertificates       = 5
+	DefaultDuplicateCertificatesWindow = 7 * 24 * time.Hour
+	DefaultFailedValidations           = 5
+	DefaultFailedValidationsWindow     = time.Hour
+	RateLimitedBackoff                 = time.Hour
+
+	WildcardLabel         = "*"
+	WildcardPrefix        = "*."
+	WildcardCacheDirLabel = "_"
+
+	CredentialPrefixFile = "file:"
+	CredentialPrefixEnv  = "env:"
 )
+
+type ChallengeType string
+
+const (
+	ChallengeTypeEmpty   ChallengeType = ""
+	ChallengeTypeHTTP    ChallengeType = "http-01"
+	ChallengeTypeDNS     ChallengeType = "dns-01"
+	ChallengeTypeUnknown ChallengeType = "unknown"
+)
+
+func ChallengeTypeFromString(s string) ChallengeType {
+
+	switch s {
+
+	case string(ChallengeTypeEmpty):
+		return ChallengeTypeEmpty
+
+	case string(ChallengeTypeHTTP):
+		return ChallengeTypeHTTP
+
+	case string(ChallengeTypeDNS):
+		return ChallengeTypeDNS
+
+	}
+
+	return ChallengeTypeUnknown
+}
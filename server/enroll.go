@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// enrollment is an enrollment token. Only the hash of the token is kept so the
+// registry does not hold a usable token
+type enrollment struct {
+	TokenHash string    `json:"tokenHash"`
+	Name      string    `json:"name,omitempty"`
+	Domains   []string  `json:"domains"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+func (t *enrollment) getEnrollment() *Enrollment {
+	return &Enrollment{
+		Name:    t.Name,
+		Domains: t.Domains,
+		Created: t.Created,
+		Expires: t.Expires,
+	}
+}
+
+// pruneEnrollments removes the expired enrollments. The caller must hold the lock
+func (t *identityStore) pruneEnrollments() {
+
+	now := time.Now()
+
+	var enrollments []*enrollment
+	for _, e := range t.registry.Enrollments {
+		if now.Before(e.Expires) {
+			enrollments = append(enrollments, e)
+		}
+	}
+
+	t.registry.Enrollments = enrollments
+}
+
+// addEnrollment adds an enrollment token for the domains that expires after
+// life and returns the enrollment and the token. If name is set the identity
+// created by the enrollment has that name
+func (t *identityStore) addEnrollment(name string, domains []string, life time.Duration) (*Enrollment, string, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(domains) == 0 {
+		return nil, "", fmt.Errorf("at least one domain is required")
+	}
+
+	for _, domain := range domains {
+		if t.domains[domain] == nil {
+			return nil, "", fmt.Errorf("domain %s not found", domain)
+		}
+	}
+
+	if life == 0 {
+		life = DefaultEnrollmentLife
+	}
+
+	if life < 0 || life > MaxEnrollmentLife {
+		return nil, "", fmt.Errorf("life must be between 0 and %s", MaxEnrollmentLife.String())
+	}
+
+	if name != "" {
+		if _, exist := t.identities[name]; exist {
+			return nil, "", fmt.Errorf("identity %s already exists", name)
+		}
+	}
+
+	token := randomString(AuthSecretSize)
+
+	e := &enrollment{
+		TokenHash: getSecretHash(token),
+		Name:      name,
+		Domains:   domains,
+		Created:   time.Now(),
+		Expires:   time.Now().Add(life),
+	}
+
+	t.pruneEnrollments()
+	t.registry.Enrollments = append(t.registry.Enrollments, e)
+
+	err := t.save()
+	if err != nil {
+		return nil, "", fmt.Errorf("enrollment could not be saved; %w", err)
+	}
+
+	zap.L().Info(fmt.Sprintf("Enrollment added for domains %v that expires at %s", domains, e.Expires.Format(time.RFC3339)))
+
+	return e.getEnrollment(), token, nil
+}
+
+// enroll exchanges the enrollment token for a new registry identity with its own
+// secret and returns the identity and the secret. The token can not be used
+// again. Name is used if the enrollment does not have a name
+func (t *identityStore) enroll(token string, name string) (*ClientIdentity, string, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.pruneEnrollments()
+
+	tokenHash := getSecretHash(token)
+
+	index := -1
+	for i, e := range t.registry.Enrollments {
+		if e.TokenHash == tokenHash {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		return nil, "", fmt.Errorf("enrollment token is not valid")
+	}
+
+	e := t.registry.Enrollments[index]
+
+	if e.Name != "" {
+		name = e.Name
+	}
+
+	if name == "" {
+		return nil, "", fmt.Errorf("name is required")
+	}
+
+	if _, exist := t.identities[name]; exist {
+		return nil, "", fmt.Errorf("identity %s already exists", name)
+	}
+
+	config := &Identity{
+		Name:    name,
+		Secret:  randomString(AuthSecretSize),
+		Domains: e.Domains,
+		Created: time.Now(),
+	}
+
+	err := t.add(config, config.Secret, IdentitySourceRegistry)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t.registry.Identities = append(t.registry.Identities, config)
+	t.registry.Enrollments = append(t.registry.Enrollments[:index], t.registry.Enrollments[index+1:]...)
+
+	err = t.save()
+	if err != nil {
+		return nil, "", fmt.Errorf("identity %s was enrolled but the registry could not be saved; %w", name, err)
+	}
+
+	zap.L().Info(fmt.Sprintf("Identity %s enrolled for domains %v", name, e.Domains))
+
+	return t.identities[name].getClientIdentity(), config.Secret, nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestIdentityStore returns an identity store for the domains a.com and
+// b.com with the config identity pi
+func newTestIdentityStore(t *testing.T) *identityStore {
+
+	t.Helper()
+
+	domains := make(map[string]*DomainWrapper)
+	for _, name := range []string{"a.com", "b.com"} {
+		domains[name] = &DomainWrapper{Domain: &Domain{Name: name}}
+	}
+
+	store, err := newIdentityStore(filepath.Join(t.TempDir(), IdentitiesFileName), newAuthServer("", "", nil), domains, []*Identity{
+		{Name: "pi", Secret: "pi secret", Domains: []string{"a.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestEnroll(t *testing.T) {
+
+	const invalidToken = "enrollment token is not valid"
+
+	tests := []struct {
+		name           string
+		enrollmentName string
+		identityName   string
+		token          string
+		expired        bool
+		err            string
+		want           string
+	}{
+		{name: "valid token", identityName: "nas", want: "nas"},
+		{name: "enrollment name is used", enrollmentName: "nas", identityName: "other", want: "nas"},
+		{name: "unknown token", identityName: "nas", token: randomString(AuthSecretSize), err: invalidToken},
+		{name: "malformed token", identityName: "nas", token: "%not a token%", err: invalidToken},
+		{name: "empty token", identityName: "nas", token: " ", err: invalidToken},
+		{name: "expired token", identityName: "nas", expired: true, err: invalidToken},
+		{name: "name collides with an identity", identityName: "pi", err: "identity pi already exists"},
+		{name: "name is required", err: "name is required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			store := newTestIdentityStore(t)
+
+			_, token, err := store.addEnrollment(test.enrollmentName, []string{"a.com"}, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.expired {
+				store.registry.Enrollments[0].Expires = time.Now().Add(-time.Second)
+			}
+
+			if test.token != "" {
+				token = test.token
+			}
+
+			identity, secret, err := store.enroll(token, test.identityName)
+
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("expected error %s, got identity %s", test.err, identity.Name)
+				}
+				// An unknown, malformed and expired token are refused alike
+				if err.Error() != test.err {
+					t.Fatalf("expected error %s, got %s", test.err, err)
+				}
+				if test.expired && len(store.registry.Enrollments) != 0 {
+					t.Fatal("expected the expired enrollment to be pruned")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if identity.Name != test.want {
+				t.Fatalf("expected identity %s, got %s", test.want, identity.Name)
+			}
+
+			// The identity is only valid for the enrolled domains
+			authToken, err := getTestToken(store.auth, secret, identity.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !authToken.isValidFor("a.com") || authToken.isValidFor("b.com") || authToken.admin {
+				t.Fatalf("expected a token valid for a.com only, got %v admin %t", authToken.domains, authToken.admin)
+			}
+
+			// The token is single use
+			_, _, err = store.enroll(token, "another")
+			if err == nil || err.Error() != invalidToken {
+				t.Fatalf("expected a used token to be refused, got %v", err)
+			}
+
+			// The identity and the used enrollment are persisted
+			reloaded, err := newIdentityStore(store.file, newAuthServer("", "", nil), store.domains, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reloaded.identities[test.want] == nil {
+				t.Fatalf("expected identity %s to be saved", test.want)
+			}
+
+			if len(reloaded.registry.Enrollments) != 0 {
+				t.Fatal("expected the used enrollment to be removed")
+			}
+		})
+	}
+}
+
+func TestAddEnrollment(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		domains []string
+		life    time.Duration
+		valid   bool
+	}{
+		{name: "", domains: []string{"a.com"}, valid: true},
+		{name: "nas", domains: []string{"a.com", "b.com"}, life: MaxEnrollmentLife, valid: true},
+		{name: "pi", domains: []string{"a.com"}},
+		{domains: nil},
+		{domains: []string{"c.com"}},
+		{domains: []string{"a.com"}, life: MaxEnrollmentLife + time.Second},
+		{domains: []string{"a.com"}, life: -time.Second},
+	}
+
+	for _, test := range tests {
+
+		store := newTestIdentityStore(t)
+
+		enrollment, token, err := store.addEnrollment(test.name, test.domains, test.life)
+
+		if !test.valid {
+			if err == nil {
+				t.Errorf("expected enrollment %s for %v life %s to be refused", test.name, test.domains, test.life)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("expected enrollment %s for %v to be added; %s", test.name, test.domains, err)
+			continue
+		}
+
+		// Only the hash of the token is kept
+		if store.registry.Enrollments[0].TokenHash == token || store.registry.Enrollments[0].TokenHash != getSecretHash(token) {
+			t.Errorf("expected the token hash to be kept")
+		}
+
+		life := test.life
+		if life == 0 {
+			life = DefaultEnrollmentLife
+		}
+
+		if until := time.Until(enrollment.Expires); until > life || until < life-time.Minute {
+			t.Errorf("expected the enrollment to expire after %s, got %s", life, until)
+		}
+	}
+}
+
+func TestPruneEnrollments(t *testing.T) {
+
+	store := newTestIdentityStore(t)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := store.addEnrollment("", []string{"a.com"}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.registry.Enrollments[0].Expires = time.Now().Add(-time.Second)
+	store.registry.Enrollments[2].Expires = time.Now().Add(-time.Second)
+
+	valid := store.registry.Enrollments[1]
+
+	store.pruneEnrollments()
+
+	if len(store.registry.Enrollments) != 1 || store.registry.Enrollments[0] != valid {
+		t.Fatalf("expected only the enrollment that has not expired to be kept, got %d", len(store.registry.Enrollments))
+	}
+}
@@ -1,12 +1,28 @@
 package server
 
+import "github.com/jodydadescott/home-simplecert/types"
+
 func ExampleConfig() *Config {
 
 	c := &Config{
-		Notes:    "If the global secret is not set then each domain secret must be set. If the global secret is set and a domain secret is set the domain secret overrides the domain secret",
-		Email:    "nobody@example.com",
-		CacheDir: "letsencrypt",
-		Secret:   "secret",
+		Notes:         "If the global secret is not set then each domain secret must be set. If the global secret is set and a domain secret is set the domain secret overrides the global secret. See the README for the other settings",
+		Email:         "nobody@example.com",
+		CacheDir:      "letsencrypt",
+		Secret:        "secret",
+		AdminSecret:   "file:/etc/home-simplecert/admin-secret",
+		DirectoryURL:  DirectoryProduction,
+		KeyType:       string(DefaultKeyType),
+		RenewBefore:   DefaultRenewBefore,
+		RenewRatio:    DefaultRenewRatio,
+		CheckInterval: DefaultCheckInterval,
+		Jitter:        DefaultJitter,
+		OCSPInterval:  DefaultOCSPInterval,
+		RetryInterval: DefaultRetryInterval,
+		InitWorkers:   DefaultInitWorkers,
+
+		ListenAddress:        DefaultListenAddress,
+		HTTPChallengeAddress: DefaultHTTPChallengeAddress,
+		TLSChallengeAddress:  DefaultTLSChallengeAddress,
 	}
 
 	c.PrimaryDomain = &Domain{
@@ -16,19 +32,57 @@ func ExampleConfig() *Config {
 	c.PrimaryDomain.AddAliases("www.example.com")
 
 	domain1 := &Domain{
-		Name: "example1.com",
+		Name:    "example1.com",
+		KeyType: string(types.KeyTypeEC256),
+		Challenge: &Challenge{
+			Webroot: "/var/www/html",
+		},
 	}
 
 	domain1.AddAliases("www.example1.com", "api.example1.com")
 
 	domain2 := &Domain{
-		Name: "example2.com",
+		Name:           "example2.com",
+		Secret:         "example2 secret",
+		Dual:           true,
+		PreferredChain: "ISRG Root X1",
 	}
 
 	domain2.AddAliases("www.example2.com")
 
+	domain3 := &Domain{
+		Name: "internal.example.com",
+		Challenge: &Challenge{
+			Type:     string(ChallengeTypeDNS),
+			Provider: "cloudflare",
+		},
+	}
+
+	domain3.Challenge.AddCredential("CLOUDFLARE_DNS_API_TOKEN", "file:/etc/home-simplecert/cloudflare-token")
+
+	domain3.AddAliases("*.internal.example.com")
+
 	c.AddDomain(domain1)
 	c.AddDomain(domain2)
+	c.AddDomain(domain3)
+
+	c.Identities = append(c.Identities, &Identity{
+		Name:    "pi",
+		Secret:  "file:/etc/home-simplecert/pi-secret",
+		Domains: []string{"example1.com"},
+	})
+
+	c.Identities = append(c.Identities, &Identity{
+		Name:               "nas",
+		CertificateSubject: "nas.internal.example.com",
+		Domains:            []string{"example2.com"},
+	})
+
+	c.ClientCA = "/etc/home-simplecert/client-ca.pem"
+
+	c.AuthLimits = &AuthLimits{
+		Deny: []string{"203.0.113.0/24"},
+	}
 
 	return c
 }
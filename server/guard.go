@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	guardKindAddress  = "address"
+	guardKindIdentity = "identity"
+)
+
+// guardEntry is the request count and lockout of an address or identity
+type guardEntry struct {
+	windowStart time.Time
+	requests    int
+	failures    int
+	lockedUntil time.Time
+	blocked     bool
+	deniedAt    time.Time
+	lastSeen    time.Time
+}
+
+// authGuard enforces the AuthLimits. Entries for addresses and identities that
+// have not been seen for MaxLockout are removed
+type authGuard struct {
+	mutex     sync.Mutex
+	limits    *AuthLimits
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	entries   map[string]*guardEntry
+	lastPrune time.Time
+}
+
+// parseCIDRs parses the CIDRs. An address without a prefix length is a single
+// address
+func parseCIDRs(name string, cidrs []string) ([]*net.IPNet, error) {
+
+	var nets []*net.IPNet
+
+	for _, cidr := range cidrs {
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("authLimits %s %s is not an address or CIDR", name, cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("authLimits %s %s is not an address or CIDR", name, cidr)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func newAuthGuard(limits *AuthLimits) (*authGuard, error) {
+
+	allow, err := parseCIDRs("allow", limits.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := parseCIDRs("deny", limits.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authGuard{
+		limits:  limits,
+		allow:   allow,
+		deny:    deny,
+		entries: make(map[string]*guardEntry),
+	}, nil
+}
+
+// getRemoteIP returns the address of the request without the port
+func getRemoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAllowed returns an error if the address is not in Allow, when Allow is
+// set, or is in Deny. A refused address is logged at most once per window
+func (t *authGuard) checkAllowed(address string) error {
+
+	if len(t.allow) == 0 && len(t.deny) == 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(address)
+
+	if ip != nil && !containsIP(t.deny, ip) && (len(t.allow) == 0 || containsIP(t.allow, ip)) {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := t.getEntry(guardKindAddress, address)
+
+	if now := time.Now(); now.Sub(entry.deniedAt) > t.limits.Window {
+		entry.deniedAt = now
+		zap.L().Warn(fmt.Sprintf("Auth address %s blocked by the allow and deny lists", address))
+	}
+
+	return fmt.Errorf("address %s is not allowed", address)
+}
+
+// getEntry returns the entry for the key. The caller must hold the lock
+func (t *authGuard) getEntry(kind, name string) *guardEntry {
+
+	now := time.Now()
+
+	if now.Sub(t.lastPrune) > t.limits.Window {
+		for key, entry := range t.entries {
+			if now.Sub(entry.lastSeen) > t.limits.MaxLockout && now.After(entry.lockedUntil) {
+				delete(t.entries, key)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	key := kind + " " + name
+
+	entry := t.entries[key]
+	if entry == nil {
+		entry = &guardEntry{}
+		t.entries[key] = entry
+	}
+
+	entry.lastSeen = now
+
+	return entry
+}
+
+// check counts a request for the address or identity and returns an error if
+// it is locked out or has made more than max requests within the window. The
+// first refused request after the address or identity was allowed is logged
+func (t *authGuard) check(kind, name string, max int) error {
+
+	if t.limits.Disabled || name == "" {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := t.getEntry(kind, name)
+
+	now := time.Now()
+
+	if now.Before(entry.lockedUntil) {
+		return fmt.Errorf("%s %s is locked out until %s", kind, name, entry.lockedUntil.Format(time.RFC3339))
+	}
+
+	if now.Sub(entry.windowStart) > t.limits.Window {
+		entry.windowStart = now
+		entry.requests = 0
+		entry.blocked = false
+	}
+
+	entry.requests++
+
+	if entry.requests > max {
+		retryAt := entry.windowStart.Add(t.limits.Window)
+		if !entry.blocked {
+			entry.blocked = true
+			zap.L().Warn(fmt.Sprintf("Auth %s %s blocked until %s; more than %d requests within %s", kind, name, retryAt.Format(time.RFC3339), max, t.limits.Window.String()))
+		}
+		return fmt.Errorf("%s %s made too many requests; retry after %s", kind, name, retryAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// fail records a failed request for the address or identity and locks it out
+// for Lockout doubled for each consecutive failure up to MaxLockout
+func (t *authGuard) fail(kind, name string) {
+
+	if t.limits.Disabled || name == "" {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := t.getEntry(kind, name)
+
+	entry.failures++
+
+	lockout := t.limits.Lockout
+	for i := 1; i < entry.failures && lockout < t.limits.MaxLockout; i++ {
+		lockout *= 2
+	}
+
+	if lockout > t.limits.MaxLockout {
+		lockout = t.limits.MaxLockout
+	}
+
+	entry.lockedUntil = time.Now().Add(lockout)
+
+	zap.L().Warn(fmt.Sprintf("Auth %s %s blocked until %s after %d consecutive failed requests", kind, name, entry.lockedUntil.Format(time.RFC3339), entry.failures))
+}
+
+// succeed clears the consecutive failures of the address or identity
+func (t *authGuard) succeed(kind, name string) {
+
+	if t.limits.Disabled || name == "" {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := t.getEntry(kind, name)
+	entry.failures = 0
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestGuard(t *testing.T, limits *AuthLimits) *authGuard {
+
+	t.Helper()
+
+	if limits.Requests == 0 {
+		limits.Requests = DefaultAuthRequests
+	}
+
+	if limits.IdentityRequests == 0 {
+		limits.IdentityRequests = DefaultAuthIdentityRequests
+	}
+
+	if limits.Window == 0 {
+		limits.Window = DefaultAuthWindow
+	}
+
+	if limits.Lockout == 0 {
+		limits.Lockout = DefaultAuthLockout
+	}
+
+	if limits.MaxLockout == 0 {
+		limits.MaxLockout = DefaultAuthMaxLockout
+	}
+
+	guard, err := newAuthGuard(limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return guard
+}
+
+func TestGuardLockout(t *testing.T) {
+
+	guard := newTestGuard(t, &AuthLimits{
+		Lockout:    time.Second,
+		MaxLockout: 10 * time.Second,
+	})
+
+	// The lockout doubles with each consecutive failure up to MaxLockout
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+
+	for i, lockout := range expected {
+
+		guard.fail(guardKindAddress, "192.0.2.1")
+
+		lockedUntil := guard.entries[guardKindAddress+" 192.0.2.1"].lockedUntil
+		remaining := time.Until(lockedUntil)
+
+		if remaining > lockout || remaining < lockout-time.Second/2 {
+			t.Fatalf("failure %d: expected lockout %s, got %s", i+1, lockout, remaining)
+		}
+	}
+
+	err := guard.check(guardKindAddress, "192.0.2.1", 100)
+	if err == nil {
+		t.Fatal("expected a locked out address to be refused")
+	}
+
+	err = guard.check(guardKindAddress, "192.0.2.2", 100)
+	if err != nil {
+		t.Fatalf("expected another address to be allowed; %s", err)
+	}
+
+	// A success clears the consecutive failures so the next lockout starts again
+	guard.succeed(guardKindAddress, "192.0.2.1")
+	guard.fail(guardKindAddress, "192.0.2.1")
+
+	remaining := time.Until(guard.entries[guardKindAddress+" 192.0.2.1"].lockedUntil)
+	if remaining > time.Second {
+		t.Fatalf("expected lockout %s after a success, got %s", time.Second, remaining)
+	}
+
+	entry := guard.entries[guardKindAddress+" 192.0.2.1"]
+	entry.lockedUntil = time.Now().Add(-time.Millisecond)
+
+	err = guard.check(guardKindAddress, "192.0.2.1", 100)
+	if err != nil {
+		t.Fatalf("expected the address to be allowed after its lockout; %s", err)
+	}
+}
+
+func TestGuardWindow(t *testing.T) {
+
+	guard := newTestGuard(t, &AuthLimits{})
+
+	tests := []struct {
+		kind string
+		name string
+		max  int
+	}{
+		{kind: guardKindAddress, name: "192.0.2.1", max: 3},
+		{kind: guardKindIdentity, name: "pi", max: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+
+			for i := 0; i < test.max; i++ {
+				err := guard.check(test.kind, test.name, test.max)
+				if err != nil {
+					t.Fatalf("request %d: expected to be allowed; %s", i+1, err)
+				}
+			}
+
+			err := guard.check(test.kind, test.name, test.max)
+			if err == nil {
+				t.Fatalf("expected request %d within the window to be refused", test.max+1)
+			}
+
+			// The address and identity windows are counted separately
+			other := guardKindIdentity
+			if test.kind == guardKindIdentity {
+				other = guardKindAddress
+			}
+
+			err = guard.check(other, test.name, test.max)
+			if err != nil {
+				t.Fatalf("expected %s %s to be allowed; %s", other, test.name, err)
+			}
+
+			// A new window starts once the window has passed
+			guard.entries[test.kind+" "+test.name].windowStart = time.Now().Add(-guard.limits.Window - time.Second)
+
+			err = guard.check(test.kind, test.name, test.max)
+			if err != nil {
+				t.Fatalf("expected to be allowed in a new window; %s", err)
+			}
+		})
+	}
+}
+
+func TestGuardDisabled(t *testing.T) {
+
+	guard := newTestGuard(t, &AuthLimits{Disabled: true})
+
+	for i := 0; i < 5; i++ {
+		guard.fail(guardKindAddress, "192.0.2.1")
+		err := guard.check(guardKindAddress, "192.0.2.1", 1)
+		if err != nil {
+			t.Fatalf("expected no limits when disabled; %s", err)
+		}
+	}
+}
+
+func TestGuardAllowDeny(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		address string
+		allowed bool
+	}{
+		{name: "no lists", address: "203.0.113.1", allowed: true},
+		{name: "in allow", allow: []string{"192.168.0.0/16"}, address: "192.168.1.10", allowed: true},
+		{name: "not in allow", allow: []string{"192.168.0.0/16"}, address: "203.0.113.1"},
+		{name: "in deny", deny: []string{"203.0.113.0/24"}, address: "203.0.113.1"},
+		{name: "not in deny", deny: []string{"203.0.113.0/24"}, address: "198.51.100.1", allowed: true},
+		{name: "deny overrides allow", allow: []string{"10.0.0.0/8"}, deny: []string{"10.0.0.5"}, address: "10.0.0.5"},
+		{name: "allow with deny", allow: []string{"10.0.0.0/8"}, deny: []string{"10.0.0.5"}, address: "10.0.0.6", allowed: true},
+		{name: "single address", allow: []string{"192.0.2.1"}, address: "192.0.2.1", allowed: true},
+		{name: "single address mismatch", allow: []string{"192.0.2.1"}, address: "192.0.2.2"},
+		{name: "ipv6", allow: []string{"2001:db8::/32"}, address: "2001:db8::1", allowed: true},
+		{name: "ipv6 mismatch", allow: []string{"2001:db8::/32"}, address: "2001:db9::1"},
+		{name: "ipv4 mapped ipv6", allow: []string{"192.0.2.0/24"}, address: "::ffff:192.0.2.1", allowed: true},
+		{name: "invalid address", allow: []string{"192.0.2.0/24"}, address: "invalid"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			guard := newTestGuard(t, &AuthLimits{Allow: test.allow, Deny: test.deny})
+
+			err := guard.checkAllowed(test.address)
+
+			if test.allowed && err != nil {
+				t.Fatalf("expected %s to be allowed; %s", test.address, err)
+			}
+
+			if !test.allowed && err == nil {
+				t.Fatalf("expected %s to be refused", test.address)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+
+	for _, cidr := range []string{"192.0.2.0/24", "192.0.2.1", "2001:db8::/32", "::1"} {
+		_, err := parseCIDRs("allow", []string{cidr})
+		if err != nil {
+			t.Errorf("expected %s to be valid; %s", cidr, err)
+		}
+	}
+
+	for _, cidr := range []string{"192.0.2.0/33", "example.com", "192.0.2", ""} {
+		_, err := parseCIDRs("allow", []string{cidr})
+		if err == nil {
+			t.Errorf("expected %s to be invalid", cidr)
+		}
+	}
+}
+
+func TestGuardIdentityLockout(t *testing.T) {
+
+	guard := newTestGuard(t, &AuthLimits{})
+
+	s := &Server{
+		auth:  newAuthServer("", "", nil),
+		guard: guard,
+	}
+
+	s.auth.setIdentity(&authSecret{identity: "pi", secret: "pi secret"})
+
+	getToken := func(address string, identity string, secret string) *TokenResponse {
+
+		request := s.auth.newRequest()
+		request.ClientNonce = randomString(AuthNonceSize)
+		request.Hash = request.GetHashFromSecret(secret)
+
+		b, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/getauthtoken?identity="+identity, bytes.NewReader(b))
+		r.RemoteAddr = address + ":40000"
+		w := httptest.NewRecorder()
+
+		s.ServeHTTP(w, r)
+
+		response := &TokenResponse{}
+		err = json.Unmarshal(w.Body.Bytes(), response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return response
+	}
+
+	// A request for an identity that does not exist only counts against the address
+	response := getToken("192.0.2.1", "unknown", "pi secret")
+	if response.Error == "" {
+		t.Fatal("expected a request for an unknown identity to fail")
+	}
+
+	if _, exist := guard.entries[guardKindIdentity+" unknown"]; exist {
+		t.Fatal("expected no guard entry for an unknown identity")
+	}
+
+	response = getToken("192.0.2.2", "pi", "wrong secret")
+	if response.Error == "" {
+		t.Fatal("expected a request with the wrong secret to fail")
+	}
+
+	if entry := guard.entries[guardKindIdentity+" pi"]; entry == nil || entry.failures != 1 {
+		t.Fatal("expected a failure to be recorded for identity pi")
+	}
+
+	// The identity is locked out for every address
+	response = getToken("192.0.2.3", "pi", "pi secret")
+	if response.Error == "" {
+		t.Fatal("expected a locked out identity to be refused")
+	}
+}
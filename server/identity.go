@@ -0,0 +1,383 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	IdentitySourceConfig   = "config"
+	IdentitySourceRegistry = "registry"
+)
+
+// identityRevocation records when an identity was revoked and the hash of the
+// secret it had. A config identity whose secret has since been changed is no
+// longer revoked
+type identityRevocation struct {
+	Time       time.Time `json:"time"`
+	SecretHash string    `json:"secretHash"`
+}
+
+// identityRegistry is the persistent part of the client identities. Identities
+// are the identities added with /addidentity or /enroll, Revoked the revocations
+// of identities from either source by name and Enrollments the enrollment
+// tokens that have not been used
+type identityRegistry struct {
+	Identities  []*Identity                    `json:"identities,omitempty"`
+	Revoked     map[string]*identityRevocation `json:"revoked,omitempty"`
+	Enrollments []*enrollment                  `json:"enrollments,omitempty"`
+}
+
+// identity is a client identity from the config or the registry
+type identity struct {
+	*Identity
+	secret    string
+	source    string
+	revokedAt time.Time
+	fetches   map[string]*CertFetch
+}
+
+// identityStore is the registry of client identities. The secret of each
+// identity is kept by the auth server so a revocation takes effect at once
+type identityStore struct {
+	mutex      sync.Mutex
+	file       string
+	auth       *authServer
+	domains    map[string]*DomainWrapper
+	registry   *identityRegistry
+	identities map[string]*identity
+}
+
+// getSecretHash returns the hash of the secret kept with a revocation
+func getSecretHash(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func newIdentityStore(file string, auth *authServer, domains map[string]*DomainWrapper, config []*Identity) (*identityStore, error) {
+
+	t := &identityStore{
+		file:       file,
+		auth:       auth,
+		domains:    domains,
+		registry:   &identityRegistry{},
+		identities: make(map[string]*identity),
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read identities %s; %w", file, err)
+		}
+	} else {
+		err = json.Unmarshal(b, t.registry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal identities %s; %w", file, err)
+		}
+	}
+
+	if t.registry.Revoked == nil {
+		t.registry.Revoked = make(map[string]*identityRevocation)
+	}
+
+	for _, config := range config {
+
+		secret, err := resolveCredential(config.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("identity %s: failed to resolve secret; %w", config.Name, err)
+		}
+
+		err = t.add(config, secret, IdentitySourceConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, registered := range t.registry.Identities {
+
+		if _, exist := t.identities[registered.Name]; exist {
+			zap.L().Warn(fmt.Sprintf("Identity %s is in the config and the registry; the registry identity is ignored", registered.Name))
+			continue
+		}
+
+		// A registry identity for a domain since removed from the config is kept
+		// in the registry but can not be used until the domain is added back
+		err = t.add(registered, registered.Secret, IdentitySourceRegistry)
+		if err != nil {
+			zap.L().Warn(fmt.Sprintf("Identity %s in the registry is ignored; %s", registered.Name, err.Error()))
+		}
+	}
+
+	return t, nil
+}
+
+// add validates the identity and adds it to the store and the auth server. The
+// caller must hold the lock or be the constructor
+func (t *identityStore) add(config *Identity, secret string, source string) error {
+
+	if config.Name == "" {
+		return fmt.Errorf("identity name is required")
+	}
+
+	if _, exist := t.identities[config.Name]; exist {
+		return fmt.Errorf("identity %s is configured more than once", config.Name)
+	}
+
+	if secret == "" && config.CertificateSubject == "" && config.CertificateSPKI == "" {
+		return fmt.Errorf("identity %s: secret, certificateSubject or certificateSpki is required", config.Name)
+	}
+
+	for _, other := range t.identities {
+
+		if config.CertificateSubject != "" && config.CertificateSubject == other.CertificateSubject {
+			return fmt.Errorf("identity %s: certificateSubject is also used by identity %s", config.Name, other.Name)
+		}
+
+		if config.CertificateSPKI != "" && config.CertificateSPKI == other.CertificateSPKI {
+			return fmt.Errorf("identity %s: certificateSpki is also used by identity %s", config.Name, other.Name)
+		}
+	}
+
+	for _, name := range config.Domains {
+		if t.domains[name] == nil {
+			return fmt.Errorf("identity %s: domain %s not found", config.Name, name)
+		}
+	}
+
+	i := &identity{
+		Identity: config,
+		secret:   secret,
+		source:   source,
+		fetches:  make(map[string]*CertFetch),
+	}
+
+	if revocation := t.registry.Revoked[config.Name]; revocation != nil && revocation.SecretHash == getSecretHash(secret) {
+		i.revokedAt = revocation.Time
+	}
+
+	domains := append([]string{}, config.Domains...)
+	sort.Strings(domains)
+
+	t.auth.setIdentity(&authSecret{
+		identity:           config.Name,
+		secret:             secret,
+		certificateSubject: config.CertificateSubject,
+		certificateSPKI:    config.CertificateSPKI,
+		domains:            domains,
+		admin:              config.Admin,
+		expires:            config.Expires,
+		revoked:            i.isRevoked(),
+	})
+
+	t.identities[config.Name] = i
+
+	return nil
+}
+
+func (t *identity) isRevoked() bool {
+	return t.Revoked || !t.revokedAt.IsZero()
+}
+
+// save writes the registry. The caller must hold the lock
+func (t *identityStore) save() error {
+
+	b, err := json.MarshalIndent(t.registry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(t.file, b, 0600)
+}
+
+// getClientIdentity returns the identity without its secret. The caller must hold the lock
+func (t *identity) getClientIdentity() *ClientIdentity {
+
+	c := &ClientIdentity{
+		Name:               t.Name,
+		Domains:            t.Domains,
+		Admin:              t.Admin,
+		CertificateSubject: t.CertificateSubject,
+		CertificateSPKI:    t.CertificateSPKI,
+		Source:             t.source,
+		Created:            t.Created,
+		Expires:            t.Expires,
+		Expired:            !t.Expires.IsZero() && time.Now().After(t.Expires),
+		Revoked:            t.isRevoked(),
+		RevokedAt:          t.revokedAt,
+	}
+
+	for _, fetch := range t.fetches {
+		c.Fetches = append(c.Fetches, fetch)
+	}
+
+	sort.Slice(c.Fetches, func(i, j int) bool {
+		if c.Fetches[i].Domain != c.Fetches[j].Domain {
+			return c.Fetches[i].Domain < c.Fetches[j].Domain
+		}
+		return c.Fetches[i].KeyType < c.Fetches[j].KeyType
+	})
+
+	return c
+}
+
+// getIdentities returns the identities sorted by name
+func (t *identityStore) getIdentities() []*ClientIdentity {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var names []string
+	for name := range t.identities {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var identities []*ClientIdentity
+	for _, name := range names {
+		identities = append(identities, t.identities[name].getClientIdentity())
+	}
+
+	return identities
+}
+
+// addIdentity adds an identity to the registry and returns the identity and its
+// secret. An identity mapped to a client certificate by subject or SPKI does not
+// have a secret, otherwise a new secret is generated
+func (t *identityStore) addIdentity(name string, domains []string, admin bool, expires time.Time, certificateSubject string, certificateSPKI string) (*ClientIdentity, string, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, exist := t.identities[name]; exist {
+		return nil, "", fmt.Errorf("identity %s already exists", name)
+	}
+
+	if len(domains) == 0 && !admin {
+		return nil, "", fmt.Errorf("identity %s: at least one domain is required", name)
+	}
+
+	config := &Identity{
+		Name:               name,
+		CertificateSubject: certificateSubject,
+		CertificateSPKI:    certificateSPKI,
+		Domains:            domains,
+		Admin:              admin,
+		Created:            time.Now(),
+		Expires:            expires,
+	}
+
+	if certificateSubject == "" && certificateSPKI == "" {
+		config.Secret = randomString(AuthSecretSize)
+	}
+
+	err := t.add(config, config.Secret, IdentitySourceRegistry)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t.registry.Identities = append(t.registry.Identities, config)
+
+	err = t.save()
+	if err != nil {
+		return nil, "", fmt.Errorf("identity %s was added but the registry could not be saved; %w", name, err)
+	}
+
+	zap.L().Info(fmt.Sprintf("Identity %s added for domains %v", name, domains))
+
+	return t.identities[name].getClientIdentity(), config.Secret, nil
+}
+
+// revokeIdentity revokes the identity. Its tokens are removed at once and it
+// can not get a new token
+func (t *identityStore) revokeIdentity(name string) (*ClientIdentity, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := t.identities[name]
+	if i == nil {
+		return nil, fmt.Errorf("identity %s not found", name)
+	}
+
+	if i.revokedAt.IsZero() {
+		i.revokedAt = time.Now()
+	}
+
+	t.auth.revokeIdentity(name)
+
+	t.registry.Revoked[name] = &identityRevocation{
+		Time:       i.revokedAt,
+		SecretHash: getSecretHash(i.secret),
+	}
+
+	err := t.save()
+	if err != nil {
+		return nil, fmt.Errorf("identity %s was revoked but the registry could not be saved; %w", name, err)
+	}
+
+	zap.L().Info(fmt.Sprintf("Identity %s revoked", name))
+
+	return i.getClientIdentity(), nil
+}
+
+// removeIdentity removes an identity added to the registry along with its
+// revocation. An identity from the config must be removed from the config
+func (t *identityStore) removeIdentity(name string) (*ClientIdentity, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := t.identities[name]
+	if i == nil {
+		return nil, fmt.Errorf("identity %s not found", name)
+	}
+
+	if i.source == IdentitySourceConfig {
+		return nil, fmt.Errorf("identity %s is in the config and must be removed from the config", name)
+	}
+
+	t.auth.removeIdentity(name)
+
+	delete(t.identities, name)
+	delete(t.registry.Revoked, name)
+
+	var identities []*Identity
+	for _, registered := range t.registry.Identities {
+		if registered.Name != name {
+			identities = append(identities, registered)
+		}
+	}
+	t.registry.Identities = identities
+
+	err := t.save()
+	if err != nil {
+		return nil, fmt.Errorf("identity %s was removed but the registry could not be saved; %w", name, err)
+	}
+
+	zap.L().Info(fmt.Sprintf("Identity %s removed", name))
+
+	return i.getClientIdentity(), nil
+}
+
+// recordFetch records the certificate fetched by the identity
+func (t *identityStore) recordFetch(name string, fetch *CertFetch) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := t.identities[name]
+	if i == nil {
+		return
+	}
+
+	i.fetches[fetch.Domain+"/"+string(fetch.KeyType)] = fetch
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"go.uber.org/zap"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	RateLimitCertificatesPerDomain = "certificatesPerDomain"
+	RateLimitDuplicateCertificates = "duplicateCertificates"
+	RateLimitFailedValidations     = "failedValidations"
+	RateLimitRateLimited           = "rateLimited"
+)
+
+// acmeRateLimitedError is the ACME problem type returned when the CA refuses an
+// order because of a rate limit
+const acmeRateLimitedError = "urn:ietf:params:acme:error:rateLimited"
+
+// acmeValidationErrors are the ACME problem types of a failed authorization.
+// Only these count against the failed validations limit so an outage of the
+// network, the CA or the DNS provider does not defer issuance once it is over
+var acmeValidationErrors = []string{
+	"urn:ietf:params:acme:error:caa",
+	"urn:ietf:params:acme:error:connection",
+	"urn:ietf:params:acme:error:dns",
+	"urn:ietf:params:acme:error:incorrectResponse",
+	"urn:ietf:params:acme:error:tls",
+	"urn:ietf:params:acme:error:unauthorized",
+}
+
+var acmeErrorPattern = regexp.MustCompile(`urn:ietf:params:acme:error:[A-Za-z]+`)
+
+// isValidationError returns true if the error is an ACME authorization failure
+func isValidationError(err error) bool {
+
+	isValidationType := func(problemType string) bool {
+		for _, t := range acmeValidationErrors {
+			if problemType == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	var problem *acme.ProblemDetails
+	if errors.As(err, &problem) {
+		if isValidationType(problem.Type) {
+			return true
+		}
+		for _, sub := range problem.SubProblems {
+			if isValidationType(sub.Type) {
+				return true
+			}
+		}
+	}
+
+	// lego returns the challenge errors in a map by domain that can not be
+	// unwrapped so the problem types are also matched in the message
+	for _, problemType := range acmeErrorPattern.FindAllString(err.Error(), -1) {
+		if isValidationType(problemType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RateLimitError is returned when issuance is deferred because it would exceed
+// a CA rate limit
+type RateLimitError struct {
+	Limit   string
+	Key     string
+	Count   int
+	Max     int
+	RetryAt time.Time
+}
+
+func (t *RateLimitError) Error() string {
+	if t.Limit == RateLimitRateLimited {
+		return fmt.Sprintf("CA rate limited issuance for %s; issuance deferred until %s", t.Key, t.RetryAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("rate limit %s for %s reached with %d of %d; issuance deferred until %s", t.Limit, t.Key, t.Count, t.Max, t.RetryAt.Format(time.RFC3339))
+}
+
+// ledgerEntry is an issuance attempt. Names is the sorted SAN set
+type ledgerEntry struct {
+	Time              time.Time `json:"time"`
+	DirectoryURL      string    `json:"directoryUrl"`
+	Names             string    `json:"names"`
+	RegisteredDomains []string  `json:"registeredDomains,omitempty"`
+	Success           bool      `json:"success,omitempty"`
+	RateLimited       bool      `json:"rateLimited,omitempty"`
+	FailedValidation  bool      `json:"failedValidation,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// ledger is the persistent record of issuance attempts used to stay within the
+// CA rate limits across restarts. Entries older than the longest window are
+// dropped when the ledger is saved
+type ledger struct {
+	mutex   sync.Mutex
+	file    string
+	limits  *RateLimits
+	entries []*ledgerEntry
+}
+
+func newLedger(file string, limits *RateLimits) *ledger {
+
+	t := &ledger{
+		file:   file,
+		limits: limits,
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			zap.L().Error(fmt.Sprintf("Failed to read ledger %s; error %s", file, err.Error()))
+		}
+		return t
+	}
+
+	err = json.Unmarshal(b, &t.entries)
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Failed to unmarshal ledger %s; error %s", file, err.Error()))
+	}
+
+	return t
+}
+
+// getSANSet returns the names sorted and joined by commas
+func getSANSet(names []string) string {
+
+	var set []string
+	for _, name := range names {
+		set = append(set, strings.ToLower(name))
+	}
+
+	sort.Strings(set)
+
+	return strings.Join(set, ",")
+}
+
+// getRegisteredDomain returns the registered domain (eTLD+1) of the name
+func getRegisteredDomain(name string) string {
+
+	name = strings.TrimPrefix(strings.ToLower(name), WildcardPrefix)
+
+	registeredDomain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+
+	return registeredDomain
+}
+
+// getRegisteredDomains returns the unique registered domains of the names
+func getRegisteredDomains(names []string) []string {
+
+	seen := make(map[string]bool)
+
+	var registeredDomains []string
+	for _, name := range names {
+		registeredDomain := getRegisteredDomain(name)
+		if !seen[registeredDomain] {
+			seen[registeredDomain] = true
+			registeredDomains = append(registeredDomains, registeredDomain)
+		}
+	}
+
+	sort.Strings(registeredDomains)
+
+	return registeredDomains
+}
+
+func (t *ledger) getMaxWindow() time.Duration {
+
+	window := RateLimitedBackoff
+
+	for _, w := range []time.Duration{t.limits.CertificatesPerDomainWindow, t.limits.DuplicateCertificatesWindow, t.limits.FailedValidationsWindow} {
+		if w > window {
+			window = w
+		}
+	}
+
+	return window
+}
+
+// record adds the result of an issuance attempt and saves the ledger. A failed
+// attempt only counts against the failed validations limit if the CA refused
+// an authorization
+func (t *ledger) record(directoryURL string, names []string, err error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := &ledgerEntry{
+		Time:              time.Now(),
+		DirectoryURL:      directoryURL,
+		Names:             getSANSet(names),
+		RegisteredDomains: getRegisteredDomains(names),
+		Success:           err == nil,
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+		entry.RateLimited = strings.Contains(entry.Error, acmeRateLimitedError)
+		entry.FailedValidation = !entry.RateLimited && isValidationError(err)
+	}
+
+	cutoff := time.Now().Add(-t.getMaxWindow())
+
+	var entries []*ledgerEntry
+	for _, e := range t.entries {
+		if e.Time.After(cutoff) {
+			entries = append(entries, e)
+		}
+	}
+
+	t.entries = append(entries, entry)
+
+	b, err := json.MarshalIndent(t.entries, "", "  ")
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Failed to marshal ledger; error %s", err.Error()))
+		return
+	}
+
+	err = os.WriteFile(t.file, b, CacheDirPerm)
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Failed to write ledger %s; error %s", t.file, err.Error()))
+	}
+}
+
+// getStatus counts the entries matching within the window. The caller must hold the lock
+func (t *ledger) getStatus(limit, key, directoryURL string, max int, window time.Duration, match func(*ledgerEntry) bool) *RateLimitStatus {
+
+	status := &RateLimitStatus{
+		Limit:        limit,
+		Key:          key,
+		DirectoryURL: directoryURL,
+		Max:          max,
+		Window:       window,
+	}
+
+	cutoff := time.Now().Add(-window)
+
+	var times []time.Time
+	for _, entry := range t.entries {
+		if entry.DirectoryURL == directoryURL && entry.Time.After(cutoff) && match(entry) {
+			times = append(times, entry.Time)
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+
+	status.Count = len(times)
+
+	status.Remaining = max - status.Count
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+
+	// Another attempt is allowed once enough of the counted attempts have left the window
+	if status.Count > 0 {
+		index := 0
+		if status.Count >= max && max > 0 {
+			index = status.Count - max
+		}
+		status.ResetAt = times[index].Add(window)
+	}
+
+	return status
+}
+
+// getStatuses returns the headroom of each limit for the names. The caller must hold the lock
+func (t *ledger) getStatuses(directoryURL string, names []string) []*RateLimitStatus {
+
+	set := getSANSet(names)
+
+	var statuses []*RateLimitStatus
+
+	for _, registeredDomain := range getRegisteredDomains(names) {
+		statuses = append(statuses, t.getStatus(RateLimitCertificatesPerDomain, registeredDomain, directoryURL,
+			t.limits.CertificatesPerDomain, t.limits.CertificatesPerDomainWindow, func(entry *ledgerEntry) bool {
+				if !entry.Success {
+					return false
+				}
+				for _, d := range entry.RegisteredDomains {
+					if d == registeredDomain {
+						return true
+					}
+				}
+				return false
+			}))
+	}
+
+	statuses = append(statuses, t.getStatus(RateLimitDuplicateCertificates, set, directoryURL,
+		t.limits.DuplicateCertificates, t.limits.DuplicateCertificatesWindow, func(entry *ledgerEntry) bool {
+			return entry.Success && entry.Names == set
+		}))
+
+	statuses = append(statuses, t.getStatus(RateLimitFailedValidations, set, directoryURL,
+		t.limits.FailedValidations, t.limits.FailedValidationsWindow, func(entry *ledgerEntry) bool {
+			return entry.FailedValidation && entry.Names == set
+		}))
+
+	return statuses
+}
+
+// check returns a RateLimitError if another attempt for the names would exceed
+// a limit or the CA rate limited the names within RateLimitedBackoff
+func (t *ledger) check(directoryURL string, names []string) error {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	set := getSANSet(names)
+
+	rateLimited := t.getStatus(RateLimitRateLimited, set, directoryURL, 1, RateLimitedBackoff, func(entry *ledgerEntry) bool {
+		return entry.RateLimited && entry.Names == set
+	})
+
+	if rateLimited.Count > 0 {
+		return &RateLimitError{
+			Limit:   RateLimitRateLimited,
+			Key:     set,
+			Count:   rateLimited.Count,
+			Max:     rateLimited.Max,
+			RetryAt: rateLimited.ResetAt,
+		}
+	}
+
+	if t.limits.Disabled {
+		return nil
+	}
+
+	for _, status := range t.getStatuses(directoryURL, names) {
+		if status.Remaining == 0 {
+			return &RateLimitError{
+				Limit:   status.Limit,
+				Key:     status.Key,
+				Count:   status.Count,
+				Max:     status.Max,
+				RetryAt: status.ResetAt,
+			}
+		}
+	}
+
+	return nil
+}
+
+// getHeadroom returns the headroom of each limit for the domains without
+// repeating a limit shared by more than one domain
+func (t *ledger) getHeadroom(domains []*DomainWrapper) []*RateLimitStatus {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	seen := make(map[string]bool)
+
+	var statuses []*RateLimitStatus
+
+	for _, domain := range domains {
+		for _, status := range t.getStatuses(domain.getDirectoryURL(), domain.getDomains()) {
+			key := status.DirectoryURL + " " + status.Limit + " " + status.Key
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// checkRateLimits returns a RateLimitError if issuance for the domain must be deferred
+func (t *DomainWrapper) checkRateLimits() error {
+	return t.ledger.check(t.getDirectoryURL(), t.getDomains())
+}
+
+// recordIssuance records the result of an issuance attempt in the ledger
+func (t *DomainWrapper) recordIssuance(err error) {
+	t.ledger.record(t.getDirectoryURL(), t.getDomains(), err)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+)
+
+func TestIsValidationError(t *testing.T) {
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "unauthorized problem",
+			err:  &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:unauthorized", HTTPStatus: 403},
+			want: true,
+		},
+		{
+			name: "wrapped dns problem",
+			err:  fmt.Errorf("failed to obtain; %w", &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:dns"}),
+			want: true,
+		},
+		{
+			name: "subproblem",
+			err: &acme.ProblemDetails{
+				Type:        "urn:ietf:params:acme:error:malformed",
+				SubProblems: []acme.SubProblem{{Type: "urn:ietf:params:acme:error:incorrectResponse"}},
+			},
+			want: true,
+		},
+		{
+			name: "challenge error by domain",
+			err:  errors.New("error: one or more domains had a problem:\n[example.com] acme: error: 400 :: urn:ietf:params:acme:error:connection :: Fetching http://example.com/.well-known/acme-challenge/x: Timeout\n"),
+			want: true,
+		},
+		{
+			name: "rate limited",
+			err:  &acme.ProblemDetails{Type: acmeRateLimitedError, HTTPStatus: 429},
+		},
+		{
+			name: "bad nonce",
+			err:  &acme.ProblemDetails{Type: acme.BadNonceErr},
+		},
+		{
+			name: "network outage",
+			err:  errors.New(`get directory at 'https://acme-v02.api.letsencrypt.org/directory': dial tcp: lookup acme-v02.api.letsencrypt.org: no such host`),
+		},
+		{
+			name: "dns provider configuration",
+			err:  errors.New("cloudflare: some credentials information are missing: CLOUDFLARE_DNS_API_TOKEN"),
+		},
+		{
+			name: "cache write",
+			err:  errors.New("open letsencrypt/example.com/cert.pem: permission denied"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isValidationError(test.err); got != test.want {
+				t.Fatalf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestLedgerFailedValidations(t *testing.T) {
+
+	limits := &RateLimits{
+		CertificatesPerDomain:       50,
+		CertificatesPerDomainWindow: 7 * 24 * time.Hour,
+		DuplicateCertificates:       5,
+		DuplicateCertificatesWindow: 7 * 24 * time.Hour,
+		FailedValidations:           2,
+		FailedValidationsWindow:     time.Hour,
+	}
+
+	l := newLedger(filepath.Join(t.TempDir(), LedgerFileName), limits)
+
+	names := []string{"example.com", "www.example.com"}
+
+	// Errors that are not authorization failures do not count
+	for i := 0; i < 5; i++ {
+		l.record(DirectoryProduction, names, errors.New("dial tcp: connection refused"))
+	}
+
+	err := l.check(DirectoryProduction, names)
+	if err != nil {
+		t.Fatalf("expected outages not to defer issuance; %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		l.record(DirectoryProduction, names, &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:unauthorized"})
+	}
+
+	err = l.check(DirectoryProduction, names)
+
+	var rateLimitError *RateLimitError
+	if !errors.As(err, &rateLimitError) || rateLimitError.Limit != RateLimitFailedValidations {
+		t.Fatalf("expected the failed validations limit, got %v", err)
+	}
+
+	// The limit is kept per directory
+	err = l.check(DirectoryStaging, names)
+	if err != nil {
+		t.Fatalf("expected another directory to be allowed; %s", err)
+	}
+}
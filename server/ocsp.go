@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	logger "github.com/jodydadescott/jody-go-logger"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// errNoOCSPServer is returned when the certificate does not have an OCSP server
+// and no OCSP responder is configured. Not all CAs run an OCSP responder
+var errNoOCSPServer = errors.New("certificate does not have an OCSP server")
+
+// oidTLSFeature is the TLS Feature extension (RFC 7633) used for must-staple
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// hasMustStaple returns true if the certificate has the TLS Feature extension
+func hasMustStaple(x509Cert *x509.Certificate) bool {
+	for _, extension := range x509Cert.Extensions {
+		if extension.Id.Equal(oidTLSFeature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *DomainWrapper) getMustStaple() bool {
+	return t.Domain.MustStaple || t.Server.mustStaple
+}
+
+func (t *DomainWrapper) getOCSPResponder() string {
+	if t.Domain.OCSPResponder != "" {
+		return t.Domain.OCSPResponder
+	}
+	return t.Server.ocspResponder
+}
+
+// getIssuer returns the certificate that issued the certificate
+func getIssuer(cr *CR) (*x509.Certificate, error) {
+
+	block, _ := pem.Decode(cr.IssuerCertificate)
+	if block == nil {
+		return nil, fmt.Errorf("issuer certificate is not PEM encoded")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// fetchOCSP requests the OCSP response for the certificate from the responder
+// in the certificate or the configured OCSP responder and verifies it against
+// the issuer
+func (t *DomainWrapper) fetchOCSP(cr *CR) ([]byte, *ocsp.Response, error) {
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issuer, err := getIssuer(cr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	responder := t.getOCSPResponder()
+	if responder == "" {
+		if len(x509Cert.OCSPServer) == 0 {
+			return nil, nil, errNoOCSPServer
+		}
+		responder = x509Cert.OCSPServer[0]
+	}
+
+	request, err := ocsp.CreateRequest(x509Cert, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpClient, err := t.getHTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := httpClient.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned status %d", responder, resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(b, x509Cert, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, response, nil
+}
+
+// updateOCSP fetches and caches the OCSP response for the current certificate
+func (t *DomainWrapper) updateOCSP() error {
+
+	cr, _ := t.get()
+	if cr == nil {
+		return fmt.Errorf("domain %s does not have a certificate", t.Name)
+	}
+
+	b, response, err := t.fetchOCSP(cr)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	// The certificate may have been renewed while the response was fetched
+	if t.cr != cr {
+		t.Unlock()
+		return nil
+	}
+	t.ocsp = b
+	t.ocspResponse = response
+	t.Unlock()
+
+	zap.L().Debug(fmt.Sprintf("Domain %s OCSP status is %s; next update is %s", t.Name, getOCSPStatus(response), response.NextUpdate.Format(time.RFC3339)))
+
+	return os.WriteFile(filepath.Join(t.getCertDir(), OCSPFileName), b, CacheDirPerm)
+}
+
+// refreshOCSP updates the OCSP response and logs any error
+func (t *DomainWrapper) refreshOCSP() {
+
+	err := t.updateOCSP()
+
+	if errors.Is(err, errNoOCSPServer) {
+		zap.L().Debug(fmt.Sprintf("Domain %s %s", t.Name, err.Error()))
+		return
+	}
+
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Domain %s failed to update OCSP; error %s", t.Name, err.Error()))
+	}
+}
+
+// loadOCSP loads the cached OCSP response if it is for the current certificate
+func (t *DomainWrapper) loadOCSP() error {
+
+	cr, _ := t.get()
+	if cr == nil {
+		return nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(t.getCertDir(), OCSPFileName))
+	if err != nil {
+		return err
+	}
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		return err
+	}
+
+	issuer, err := getIssuer(cr)
+	if err != nil {
+		return err
+	}
+
+	response, err := ocsp.ParseResponseForCert(b, x509Cert, issuer)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	t.ocsp = b
+	t.ocspResponse = response
+	t.Unlock()
+
+	return nil
+}
+
+// getOCSP returns the cached OCSP response and when it should next be updated
+func (t *DomainWrapper) getOCSP() ([]byte, time.Time) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.ocspResponse == nil {
+		return nil, time.Time{}
+	}
+	return t.ocsp, t.ocspResponse.NextUpdate
+}
+
+func getOCSPStatus(response *ocsp.Response) string {
+	switch response.Status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// getOCSPDelay returns the OCSP interval shortened to half way between the
+// response this update and next update if that is sooner
+func (t *DomainWrapper) getOCSPDelay() time.Duration {
+
+	delay := t.ocspInterval
+
+	t.RLock()
+	response := t.ocspResponse
+	t.RUnlock()
+
+	if response == nil || response.NextUpdate.IsZero() {
+		return delay
+	}
+
+	until := time.Until(response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2))
+	if until > time.Minute && until < delay {
+		return until
+	}
+
+	return delay
+}
+
+// ocspRoutine periodically fetches the OCSP response for the certificate, or
+// checks its CRL if it does not have an OCSP server, and triggers a reissue if
+// the certificate was revoked
+func (t *DomainWrapper) ocspRoutine(ctx context.Context) {
+
+	defer func() {
+
+		if logger.Trace {
+			zap.L().Debug("t.wg.Done()")
+		}
+
+		t.wg.Done()
+
+		zap.L().Debug(fmt.Sprintf("Closing OCSP for domain %s", t.Name))
+	}()
+
+	// A cached response is only refreshed when it is due. Without a certificate
+	// there is nothing to check until renew obtains one, which also fetches its
+	// OCSP response
+	delay := t.getOCSPDelay()
+	if cr, _ := t.get(); cr != nil {
+		if ocsp, _ := t.getOCSP(); ocsp == nil {
+			delay = 0
+		}
+	}
+
+	for {
+
+		timer := time.NewTimer(delay)
+
+		select {
+
+		case <-ctx.Done():
+			timer.Stop()
+			return
+
+		case <-timer.C:
+			t.checkRevocation()
+
+		}
+
+		delay = t.getOCSPDelay()
+	}
+}
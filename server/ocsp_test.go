@@ -0,0 +1,355 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues leaf certificates and answers OCSP and CRL requests for them
+type testCA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	status  int
+	revoked []*big.Int
+	server  *httptest.Server
+}
+
+func newTestCA(t *testing.T) *testCA {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{
+		cert:   cert,
+		key:    key,
+		status: ocsp.Good,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ocsp", ca.serveOCSP)
+	mux.HandleFunc("/crl", ca.serveCRL)
+
+	ca.server = httptest.NewServer(mux)
+	t.Cleanup(ca.server.Close)
+
+	return ca
+}
+
+func (t *testCA) serveOCSP(w http.ResponseWriter, r *http.Request) {
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request, err := ocsp.ParseRequest(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	template := ocsp.Response{
+		Status:       t.status,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   time.Now().Add(3 * time.Hour),
+	}
+
+	if t.status == ocsp.Revoked {
+		template.RevokedAt = time.Now().Add(-time.Minute)
+		template.RevocationReason = ocsp.KeyCompromise
+	}
+
+	response, err := ocsp.CreateResponse(t.cert, t.cert, template, t.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+func (t *testCA) serveCRL(w http.ResponseWriter, r *http.Request) {
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+
+	for _, serial := range t.revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, template, t.cert, t.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(crl)
+}
+
+// issue returns a CR for a leaf certificate and key with the serial. Its OCSP server
+// and CRL distribution point are set if ocspServer and crl are true
+func (t *testCA) issue(tt *testing.T, serial int64, ocspServer bool, crl bool) *CR {
+
+	tt.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tt.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ocspServer {
+		template.OCSPServer = []string{t.server.URL + "/ocsp"}
+	}
+
+	if crl {
+		template.CRLDistributionPoints = []string{t.server.URL + "/crl"}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, t.cert, &key.PublicKey, t.key)
+	if err != nil {
+		tt.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tt.Fatal(err)
+	}
+
+	return &CR{
+		Domain:            "example.com",
+		Certificate:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		PrivateKey:        pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		IssuerCertificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: t.cert.Raw}),
+	}
+}
+
+func newTestDomain(t *testing.T, cr *CR) *DomainWrapper {
+
+	t.Helper()
+
+	return &DomainWrapper{
+		Domain:  &Domain{Name: "example.com"},
+		cr:      cr,
+		certDir: t.TempDir(),
+		reissue: make(chan struct{}, 1),
+		Server: &Server{
+			ocspInterval: DefaultOCSPInterval,
+		},
+	}
+}
+
+// isReissueTriggered returns true if a reissue was triggered
+func isReissueTriggered(domain *DomainWrapper) bool {
+	select {
+	case <-domain.reissue:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestCheckRevocation(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		ocspServer bool
+		crl        bool
+		ocspStatus int
+		crlRevoked bool
+		revoked    bool
+	}{
+		{name: "ocsp good", ocspServer: true, ocspStatus: ocsp.Good},
+		{name: "ocsp revoked", ocspServer: true, ocspStatus: ocsp.Revoked, revoked: true},
+		{name: "ocsp is preferred over crl", ocspServer: true, crl: true, ocspStatus: ocsp.Good, crlRevoked: true},
+		{name: "crl good", crl: true},
+		{name: "crl revoked", crl: true, crlRevoked: true, revoked: true},
+		{name: "no revocation source"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			ca := newTestCA(t)
+			ca.status = test.ocspStatus
+
+			cr := ca.issue(t, 100, test.ocspServer, test.crl)
+
+			if test.crlRevoked {
+				ca.revoked = []*big.Int{big.NewInt(99), big.NewInt(100)}
+			}
+
+			domain := newTestDomain(t, cr)
+
+			domain.checkRevocation()
+
+			if isReissueTriggered(domain) != test.revoked {
+				t.Fatalf("expected reissue %t", test.revoked)
+			}
+
+			// The next renewal replaces a certificate marked revoked
+			if (domain.revokedSerial != "") != test.revoked {
+				t.Fatalf("expected the certificate revoked to be %t", test.revoked)
+			}
+
+			// Only a certificate checked by OCSP has a cached response
+			b, _ := domain.getOCSP()
+			if test.ocspServer && b == nil {
+				t.Fatal("expected the OCSP response to be cached")
+			}
+
+			if !test.ocspServer && b != nil {
+				t.Fatal("expected no OCSP response")
+			}
+		})
+	}
+}
+
+func TestCheckRevocationWithoutCertificate(t *testing.T) {
+
+	domain := newTestDomain(t, nil)
+
+	domain.checkRevocation()
+
+	if isReissueTriggered(domain) {
+		t.Fatal("expected no reissue for a domain without a certificate")
+	}
+}
+
+func TestOCSPResponder(t *testing.T) {
+
+	ca := newTestCA(t)
+	ca.status = ocsp.Revoked
+
+	// The configured responder is used although the certificate has no OCSP server
+	domain := newTestDomain(t, ca.issue(t, 100, false, false))
+	domain.Server.ocspResponder = ca.server.URL + "/ocsp"
+
+	revoked, err := domain.isRevoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !revoked {
+		t.Fatal("expected the certificate to be revoked")
+	}
+}
+
+func TestCheckCRLSignature(t *testing.T) {
+
+	ca := newTestCA(t)
+	other := newTestCA(t)
+
+	// The CRL is signed by another CA so it must be refused
+	cr := ca.issue(t, 100, false, true)
+	cr.IssuerCertificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.cert.Raw})
+
+	_, err := newTestDomain(t, cr).checkCRL(cr)
+	if err == nil {
+		t.Fatal("expected a CRL signed by another CA to be refused")
+	}
+}
+
+func TestGetOCSPDelay(t *testing.T) {
+
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		response *ocsp.Response
+		want     time.Duration
+	}{
+		{
+			name: "no response",
+			want: DefaultOCSPInterval,
+		},
+		{
+			name:     "no next update",
+			response: &ocsp.Response{ThisUpdate: now},
+			want:     DefaultOCSPInterval,
+		},
+		{
+			name:     "half way is sooner",
+			response: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(4 * time.Hour)},
+			want:     2 * time.Hour,
+		},
+		{
+			name:     "interval is sooner",
+			response: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(7 * 24 * time.Hour)},
+			want:     DefaultOCSPInterval,
+		},
+		{
+			name:     "half way has passed",
+			response: &ocsp.Response{ThisUpdate: now.Add(-4 * time.Hour), NextUpdate: now.Add(time.Hour)},
+			want:     DefaultOCSPInterval,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			domain := newTestDomain(t, nil)
+			domain.ocspResponse = test.response
+
+			delay := domain.getOCSPDelay()
+
+			if delay > test.want || delay < test.want-time.Minute {
+				t.Fatalf("expected delay %s, got %s", test.want, delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+//go:build integration
+
+package server
+
+// The integration tests obtain certificates from pebble with the dns-01
+// challenge answered by pebble-challtestsrv. Run pebble with
+//
+//	pebble-challtestsrv -defaultIPv6 "" -defaultIPv4 127.0.0.1
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//
+// and then
+//
+//	PEBBLE_CA_BUNDLE=test/certs/pebble.minica.pem go test -tags integration ./server/
+//
+// PEBBLE_DIRECTORY_URL, PEBBLE_CHALLTESTSRV_URL and PEBBLE_DNS_RESOLVER
+// override the pebble defaults
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+func getTestEnv(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// challtestsrvProvider sets the dns-01 TXT records with the pebble-challtestsrv
+// management API and records the domains it presented
+type challtestsrvProvider struct {
+	mutex     sync.Mutex
+	url       string
+	presented []string
+}
+
+func (t *challtestsrvProvider) post(path string, request any) error {
+
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(t.url+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (t *challtestsrvProvider) Present(domain, token, keyAuth string) error {
+
+	t.mutex.Lock()
+	t.presented = append(t.presented, domain)
+	t.mutex.Unlock()
+
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+
+	return t.post("/set-txt", map[string]string{"host": fqdn, "value": value})
+}
+
+func (t *challtestsrvProvider) CleanUp(domain, token, keyAuth string) error {
+
+	fqdn, _ := dns01.GetRecord(domain, keyAuth)
+
+	return t.post("/clear-txt", map[string]string{"host": fqdn})
+}
+
+func (t *challtestsrvProvider) getPresented() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string{}, t.presented...)
+}
+
+// registerChalltestsrvProvider registers a provider with the name that
+// requires the credential so the credentials of each domain are checked
+func registerChalltestsrvProvider(t *testing.T, name string, credential string) *challtestsrvProvider {
+
+	t.Helper()
+
+	provider := &challtestsrvProvider{
+		url: getTestEnv("PEBBLE_CHALLTESTSRV_URL", "http://localhost:8055"),
+	}
+
+	dnsProviders[name] = func(credentials map[string]string) (challenge.Provider, error) {
+		if credentials["CHALLTESTSRV_TOKEN"] != credential {
+			return nil, fmt.Errorf("provider %s expected credential %s, got %s", name, credential, credentials["CHALLTESTSRV_TOKEN"])
+		}
+		return provider, nil
+	}
+
+	t.Cleanup(func() {
+		delete(dnsProviders, name)
+	})
+
+	return provider
+}
+
+func TestPebbleDNSProviders(t *testing.T) {
+
+	caBundle := os.Getenv("PEBBLE_CA_BUNDLE")
+	if caBundle == "" {
+		t.Skip("PEBBLE_CA_BUNDLE is not set")
+	}
+
+	providerA := registerChalltestsrvProvider(t, "challtestsrv-a", "a token")
+	providerB := registerChalltestsrvProvider(t, "challtestsrv-b", "b token")
+
+	newChallenge := func(provider, credential string) *Challenge {
+		c := &Challenge{
+			Type:                    string(ChallengeTypeDNS),
+			Provider:                provider,
+			Resolvers:               []string{getTestEnv("PEBBLE_DNS_RESOLVER", "127.0.0.1:8053")},
+			DisablePropagationCheck: true,
+		}
+		c.AddCredential("CHALLTESTSRV_TOKEN", credential)
+		return c
+	}
+
+	config := &Config{
+		Email:        "nobody@example.com",
+		CacheDir:     t.TempDir(),
+		Secret:       "secret",
+		DirectoryURL: getTestEnv("PEBBLE_DIRECTORY_URL", "https://localhost:14000/dir"),
+		CABundle:     caBundle,
+		RateLimits:   &RateLimits{Disabled: true},
+	}
+
+	config.PrimaryDomain = &Domain{
+		Name:      "a.example.test",
+		Challenge: newChallenge("challtestsrv-a", "a token"),
+	}
+
+	config.PrimaryDomain.AddAliases("*.a.example.test")
+
+	config.AddDomain(&Domain{
+		Name:      "b.example.test",
+		Challenge: newChallenge("challtestsrv-b", "b token"),
+	})
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The domains are renewed one after the other as each provider is only
+	// allowed to present its own domain
+	for _, name := range []string{"a.example.test", "b.example.test"} {
+
+		domain := s.domains[name]
+
+		err = os.MkdirAll(domain.getCertDir(), CacheDirPerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = domain.renew()
+		if err != nil {
+			t.Fatalf("domain %s: %s", name, err)
+		}
+
+		cr, err := domain.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x509Cert, err := parseCertificate(cr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if domain.domainsChanged(x509Cert) {
+			t.Fatalf("domain %s certificate names %v do not match", name, x509Cert.DNSNames)
+		}
+	}
+
+	for _, test := range []struct {
+		provider *challtestsrvProvider
+		domains  []string
+	}{
+		{provider: providerA, domains: []string{"a.example.test", "*.a.example.test"}},
+		{provider: providerB, domains: []string{"b.example.test"}},
+	} {
+		presented := test.provider.getPresented()
+		if len(presented) != len(test.domains) {
+			t.Fatalf("expected %v to be presented, got %v", test.domains, presented)
+		}
+		for _, domain := range test.domains {
+			found := false
+			for _, p := range presented {
+				found = found || p == domain
+			}
+			if !found {
+				t.Fatalf("expected %s to be presented, got %v", domain, presented)
+			}
+		}
+	}
+
+	// A revoked certificate is reissued by the next renewal
+	domain := s.domains["b.example.test"]
+
+	response, err := domain.revoke(types.RevocationReasonSuperseded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-domain.reissue:
+	default:
+		t.Fatal("expected a reissue to be triggered")
+	}
+
+	err = domain.renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cr, _ := domain.get()
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if types.GetSerial(x509Cert) == response.RevokedSerial {
+		t.Fatal("expected the revoked certificate to be reissued")
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// profileTransport adds the ACME profile to new order requests. lego does not
+// support profiles so the JWS payload of the new order request is rewritten and
+// signed again with the account key. The protected header, including the nonce,
+// is left unchanged
+type profileTransport struct {
+	http.RoundTripper
+	newOrderURL string
+	profile     string
+	key         *rsa.PrivateKey
+}
+
+type flattenedJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func (t *profileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if req.Method != http.MethodPost || req.URL.String() != t.newOrderURL || req.Body == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = t.addProfile(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add profile %s to order; %w", t.profile, err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func (t *profileTransport) addProfile(b []byte) ([]byte, error) {
+
+	var jws flattenedJWS
+	err := json.Unmarshal(b, &jws)
+	if err != nil {
+		return nil, err
+	}
+
+	protectedBytes, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+
+	var protected struct {
+		Algorithm string `json:"alg"`
+	}
+
+	err = json.Unmarshal(protectedBytes, &protected)
+	if err != nil {
+		return nil, err
+	}
+
+	if protected.Algorithm != "RS256" {
+		return nil, fmt.Errorf("signature algorithm %s is not supported", protected.Algorithm)
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make(map[string]any)
+	err = json.Unmarshal(payloadBytes, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payload["profile"] = t.profile
+
+	payloadBytes, err = json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	jws.Payload = base64.RawURLEncoding.EncodeToString(payloadBytes)
+
+	err = jws.sign(t.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jws)
+}
+
+// sign sets the RS256 signature of the protected header and payload
+func (t *flattenedJWS) sign(key *rsa.PrivateKey) error {
+
+	hash := sha256.Sum256([]byte(t.Protected + "." + t.Payload))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+
+	t.Signature = base64.RawURLEncoding.EncodeToString(signature)
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-acme/lego/v4/acme"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+// errNoRevocationSource is returned when the certificate has neither an OCSP
+// server nor a CRL distribution point so its revocation can not be checked
+var errNoRevocationSource = errors.New("certificate does not have an OCSP server or CRL distribution point")
+
+// revoke revokes the current certificate with the reason and wakes the renewal
+// routine to reissue it, which retries a failed reissue with its backoff. The
+// reissue may take minutes with the dns-01 challenge so it is not waited for
+func (t *DomainWrapper) revoke(reason RevocationReason) (*RevokeResponse, error) {
+
+	cr, _ := t.get()
+	if cr == nil {
+		return nil, fmt.Errorf("domain %s does not have a certificate", t.Name)
+	}
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	core, err := t.getCore()
+	if err != nil {
+		return nil, err
+	}
+
+	code := reason.GetCode()
+
+	err = core.Certificates.Revoke(acme.RevokeCertMessage{
+		Certificate: base64.RawURLEncoding.EncodeToString(x509Cert.Raw),
+		Reason:      &code,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke certificate serial %s; %w", types.GetSerial(x509Cert), err)
+	}
+
+	response := &RevokeResponse{
+		Domain:        t.Name,
+		KeyType:       t.keyType,
+		Reason:        reason,
+		RevokedSerial: types.GetSerial(x509Cert),
+	}
+
+	zap.L().Warn(fmt.Sprintf("Domain %s certificate serial %s was revoked; reason %s", t.Name, response.RevokedSerial, string(reason)))
+
+	t.setRevoked(response.RevokedSerial, string(reason))
+	t.triggerReissue()
+
+	return response, nil
+}
+
+// setRevoked marks the certificate with the serial as revoked so the next
+// renewal replaces it
+func (t *DomainWrapper) setRevoked(serial, reason string) {
+	t.Lock()
+	defer t.Unlock()
+	t.revokedSerial = serial
+	t.revokedReason = reason
+}
+
+// getRevoked returns the reason the certificate was revoked or an empty string
+// if it was not
+func (t *DomainWrapper) getRevoked(serial string) string {
+	t.RLock()
+	defer t.RUnlock()
+	if t.revokedSerial == "" || t.revokedSerial != serial {
+		return ""
+	}
+	return fmt.Sprintf("certificate serial %s was revoked; reason %s", serial, t.revokedReason)
+}
+
+// triggerReissue wakes the renewal routine so it renews now
+func (t *DomainWrapper) triggerReissue() {
+	select {
+	case t.reissue <- struct{}{}:
+	default:
+	}
+}
+
+// checkCRL returns true if the certificate is listed on the CRL of its
+// distribution point
+func (t *DomainWrapper) checkCRL(cr *CR) (bool, error) {
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		return false, err
+	}
+
+	if len(x509Cert.CRLDistributionPoints) == 0 {
+		return false, errNoRevocationSource
+	}
+
+	issuer, err := getIssuer(cr)
+	if err != nil {
+		return false, err
+	}
+
+	httpClient, err := t.getHTTPClient()
+	if err != nil {
+		return false, err
+	}
+
+	distributionPoint := x509Cert.CRLDistributionPoints[0]
+
+	resp, err := httpClient.Get(distributionPoint)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s returned status %d", distributionPoint, resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return false, err
+	}
+
+	err = crl.CheckSignatureFrom(issuer)
+	if err != nil {
+		return false, fmt.Errorf("CRL %s signature is invalid; %w", distributionPoint, err)
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(x509Cert.SerialNumber) == 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isRevoked updates the OCSP response and returns true if the certificate is
+// revoked. If the certificate does not have an OCSP server its CRL is checked
+func (t *DomainWrapper) isRevoked() (bool, error) {
+
+	err := t.updateOCSP()
+
+	if err == nil {
+		t.RLock()
+		defer t.RUnlock()
+		return t.ocspResponse != nil && t.ocspResponse.Status == ocsp.Revoked, nil
+	}
+
+	if !errors.Is(err, errNoOCSPServer) {
+		return false, err
+	}
+
+	cr, _ := t.get()
+	if cr == nil {
+		return false, nil
+	}
+
+	return t.checkCRL(cr)
+}
+
+// checkRevocation checks if the certificate was revoked by the CA and if so
+// triggers a reissue. A domain without a certificate is not checked
+func (t *DomainWrapper) checkRevocation() {
+
+	if cr, _ := t.get(); cr == nil {
+		zap.L().Debug(fmt.Sprintf("Domain %s does not have a certificate to check", t.Name))
+		return
+	}
+
+	revoked, err := t.isRevoked()
+
+	if errors.Is(err, errNoRevocationSource) {
+		zap.L().Debug(fmt.Sprintf("Domain %s %s", t.Name, err.Error()))
+		return
+	}
+
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Domain %s failed to check revocation; error %s", t.Name, err.Error()))
+		return
+	}
+
+	if !revoked {
+		return
+	}
+
+	cr, _ := t.get()
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		return
+	}
+
+	serial := types.GetSerial(x509Cert)
+
+	zap.L().Warn(fmt.Sprintf("Domain %s certificate serial %s was revoked by the CA; reissuing", t.Name, serial))
+
+	t.setRevoked(serial, "revoked by the CA")
+	t.triggerReissue()
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/registration"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+// testACME is an ACME server stub that answers the requests lego does not wrap
+// in an order and records them
+type testACME struct {
+	mutex    sync.Mutex
+	server   *httptest.Server
+	nonce    int
+	requests map[string][]*testJWS
+	problems map[string]int
+}
+
+// testJWS is a flattened JWS posted to the stub with its decoded parts
+type testJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+
+	protected map[string]any
+	payload   []byte
+}
+
+func decodeTestJWS(b []byte) (*testJWS, error) {
+
+	jws := &testJWS{}
+
+	err := json.Unmarshal(b, jws)
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(protected, &jws.protected)
+	if err != nil {
+		return nil, err
+	}
+
+	jws.payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return jws, nil
+}
+
+func newTestACME(t *testing.T) *testACME {
+
+	t.Helper()
+
+	acme := &testACME{
+		requests: make(map[string][]*testJWS),
+		problems: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   acme.server.URL + "/nonce",
+			"newAccount": acme.server.URL + "/account",
+			"newOrder":   acme.server.URL + "/order",
+			"revokeCert": acme.server.URL + "/revoke",
+			"keyChange":  acme.server.URL + "/key-change",
+		})
+	})
+
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		acme.setNonce(w)
+	})
+
+	for _, path := range []string{"/revoke", "/key-change"} {
+		path := path
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+
+			acme.setNonce(w)
+
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			jws, err := decodeTestJWS(b)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			acme.mutex.Lock()
+			acme.requests[path] = append(acme.requests[path], jws)
+			status := acme.problems[path]
+			acme.mutex.Unlock()
+
+			if status != 0 {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(map[string]string{
+					"type":   "urn:ietf:params:acme:error:malformed",
+					"detail": "refused by the stub",
+				})
+			}
+		})
+	}
+
+	acme.server = httptest.NewServer(mux)
+	t.Cleanup(acme.server.Close)
+
+	return acme
+}
+
+func (t *testACME) setNonce(w http.ResponseWriter) {
+	t.mutex.Lock()
+	t.nonce++
+	nonce := fmt.Sprintf("nonce-%d", t.nonce)
+	t.mutex.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+// setProblem makes the stub refuse the requests to the path with the status
+func (t *testACME) setProblem(path string, status int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.problems[path] = status
+}
+
+func (t *testACME) getRequests(path string) []*testJWS {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.requests[path]
+}
+
+// newTestRegisteredDomain returns a domain with the certificate and an account
+// registered with the stub
+func newTestRegisteredDomain(t *testing.T, acme *testACME, cr *CR) *DomainWrapper {
+
+	t.Helper()
+
+	s := &Server{
+		cacheDir:      t.TempDir(),
+		directoryURL:  acme.server.URL + "/dir",
+		email:         "nobody@example.com",
+		checkInterval: DefaultCheckInterval,
+		retryInterval: DefaultRetryInterval,
+		renewBefore:   DefaultRenewBefore,
+		renewRatio:    DefaultRenewRatio,
+		jitter:        time.Hour,
+		ocspInterval:  DefaultOCSPInterval,
+	}
+
+	domain := &DomainWrapper{
+		Domain:  &Domain{Name: "example.com"},
+		Server:  s,
+		cr:      cr,
+		keyType: types.KeyTypeEC256,
+		reissue: make(chan struct{}, 1),
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = domain.saveUser(&User{
+		Email:        s.email,
+		Key:          key,
+		DirectoryURL: s.directoryURL,
+		Registration: &registration.Resource{URI: acme.server.URL + "/acct/1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return domain
+}
+
+func TestRevoke(t *testing.T) {
+
+	acme := newTestACME(t)
+	cr := newTestCA(t).issue(t, 100, false, false)
+
+	domain := newTestRegisteredDomain(t, acme, cr)
+
+	// Any renewal is refused by the ledger so the reissue is seen without an order
+	domain.Server.ledger = newLedger(filepath.Join(domain.cacheDir, LedgerFileName), &RateLimits{})
+	domain.Server.ledger.entries = append(domain.Server.ledger.entries, &ledgerEntry{
+		Time:         time.Now(),
+		DirectoryURL: domain.getDirectoryURL(),
+		Names:        getSANSet(domain.getDomains()),
+		RateLimited:  true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		domain.wg.Wait()
+	}()
+
+	domain.wg.Add(1)
+	go domain.renewalRoutine(ctx, time.Hour)
+
+	response, err := domain.revoke(types.RevocationReasonKeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.RevokedSerial != types.GetSerial(x509Cert) {
+		t.Fatalf("expected revoked serial %s, got %s", types.GetSerial(x509Cert), response.RevokedSerial)
+	}
+
+	requests := acme.getRequests("/revoke")
+	if len(requests) != 1 {
+		t.Fatalf("expected one revocation request, got %d", len(requests))
+	}
+
+	message := &struct {
+		Certificate string `json:"certificate"`
+		Reason      *uint  `json:"reason"`
+	}{}
+
+	err = json.Unmarshal(requests[0].payload, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Certificate != base64.RawURLEncoding.EncodeToString(x509Cert.Raw) {
+		t.Fatal("expected the certificate to be revoked")
+	}
+
+	if message.Reason == nil || *message.Reason != types.RevocationReasonKeyCompromise.GetCode() {
+		t.Fatalf("expected reason %d", types.RevocationReasonKeyCompromise.GetCode())
+	}
+
+	if requests[0].protected["kid"] != acme.server.URL+"/acct/1" {
+		t.Fatalf("expected the request to be signed by the account, got %v", requests[0].protected["kid"])
+	}
+
+	// The renewal routine is woken to reissue the revoked certificate
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+
+		var rateLimitErr *RateLimitError
+		if _, err := domain.get(); errors.As(err, &rateLimitErr) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the renewal routine to reissue the revoked certificate")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if domain.getRevoked(response.RevokedSerial) == "" {
+		t.Fatal("expected the certificate to stay marked revoked until it is reissued")
+	}
+}
+
+func TestRevokeWithoutCertificate(t *testing.T) {
+
+	acme := newTestACME(t)
+
+	domain := newTestRegisteredDomain(t, acme, nil)
+
+	_, err := domain.revoke(types.RevocationReasonUnspecified)
+	if err == nil {
+		t.Fatal("expected an error for a domain without a certificate")
+	}
+
+	if len(acme.getRequests("/revoke")) != 0 {
+		t.Fatal("expected no revocation request")
+	}
+}
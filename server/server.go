@@ -2,20 +2,27 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/foomo/simplecert"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	logger "github.com/jodydadescott/jody-go-logger"
-	hashserver "github.com/jodydadescott/simple-go-hash-auth/server"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
 
 	"github.com/jodydadescott/home-simplecert/types"
 )
@@ -23,103 +30,231 @@ import (
 type DomainWrapper struct {
 	sync.RWMutex
 	*Domain
-	cr  *CR
-	err error
+	cr        *CR
+	chains    []*Chain
+	ocsp      []byte
+	err       error
+	keyType   KeyType
+	certDir   string
+	variant   *DomainWrapper
+	nextCheck time.Time
+
+	renewalInfo   *RenewalInfo
+	renewalTime   time.Time
+	lastRenewal   time.Time
+	renewalReason string
+	failures      int
+	initialized   bool
+	revokedSerial string
+	revokedReason string
+
+	// renewMutex serializes renewals from the renewal routine and revocation
+	renewMutex sync.Mutex
+	reissue    chan struct{}
+
+	ocspResponse *ocsp.Response
+
 	*Server
 }
 
-func (t *DomainWrapper) init() error {
+func (t *DomainWrapper) init(ctx context.Context) error {
 
 	if logger.Trace {
-		zap.L().Debug("func (t *DomainWrapper) init() error")
+		zap.L().Debug("func (t *DomainWrapper) init(ctx context.Context) error")
 	}
 
-	cacheDir := filepath.Join(t.cacheDir, t.Name)
+	certDir := t.getCertDir()
 	if logger.Trace {
-		zap.L().Debug(fmt.Sprintf("CacheDir is %s", cacheDir))
+		zap.L().Debug(fmt.Sprintf("CertDir is %s", certDir))
 	}
 
-	load := func() error {
+	err := os.MkdirAll(certDir, CacheDirPerm)
+	if err != nil {
+		t.setErr(err)
+		zap.L().Error(fmt.Sprintf("Processing domain %s had error %s", t.Name, err.Error()))
+		return err
+	}
 
+	cr, err := t.loadCR()
+	if err == nil {
 		t.Lock()
-		defer t.Unlock()
+		t.cr = cr
+		t.Unlock()
+		t.updateServedCertificate(cr)
+	} else if !os.IsNotExist(err) {
+		zap.L().Error(fmt.Sprintf("Processing domain %s had error %s", t.Name, err.Error()))
+	}
 
-		b, err := os.ReadFile(filepath.Join(cacheDir, CertResourceFileName))
-		if err != nil {
-			t.err = err
-			zap.L().Error(fmt.Sprintf("Processing domain %s had error %s", t.Name, err.Error()))
-			return err
+	if cr != nil {
+		chains, err := t.loadChains()
+		if err != nil && !os.IsNotExist(err) {
+			zap.L().Error(fmt.Sprintf("Processing domain %s chains had error %s", t.Name, err.Error()))
 		}
+		t.Lock()
+		t.chains = chains
+		t.Unlock()
 
-		cr := &CR{}
-		err = json.Unmarshal(b, cr)
-		if err != nil {
-			t.err = err
-			zap.L().Error(fmt.Sprintf("Processing domain %s had error %s", t.Name, err.Error()))
-			return err
+		err = t.loadOCSP()
+		if err != nil && !os.IsNotExist(err) {
+			zap.L().Debug(fmt.Sprintf("Processing domain %s OCSP had error %s", t.Name, err.Error()))
 		}
-		t.cr = cr
+	}
 
-		return nil
+	// A cached certificate is checked after a random delay so that a restart does
+	// not send every domain to the ACME server at the same time. Without one the
+	// certificate is obtained now, or in the background on a degraded startup.
+	delay := t.getJitterDelay()
+
+	if cr == nil {
+		if t.degradedStartup {
+			delay = 0
+		} else {
+			err = t.renew()
+			delay = t.getNextDelay(err)
+		}
 	}
 
-	setErr := func(err error) {
-		t.Lock()
-		defer t.Unlock()
-		t.err = err
-	}
-
-	cfg := &simplecert.Config{
-		CacheDir:      cacheDir,
-		RenewBefore:   30 * 24,
-		CheckInterval: 2 * 24 * time.Hour,
-		DirectoryURL:  "https://acme-v02.api.letsencrypt.org/directory",
-		HTTPAddress:   ":80",
-		TLSAddress:    ":443",
-		CacheDirPerm:  0700,
-		SSLEmail:      t.email,
-		KeyType:       simplecert.RSA2048,
-		WillRenewCertificate: func() {
-			zap.L().Info(fmt.Sprintf("Renewing domain %s", t.Name))
-			t.stopServer()
-		},
-		DidRenewCertificate: func() {
-			zap.L().Info(fmt.Sprintf("Renewed domain %s", t.Name))
-			load()
-			t.startServer()
-		},
-		FailedToRenewCertificate: func(err error) {
+	t.wg.Add(1)
+
+	if logger.Trace {
+		zap.L().Debug("t.wg.Add(1)")
+	}
 
-			setErr(err)
+	go t.renewalRoutine(ctx, delay)
 
-			if t.Name == t.primaryDomain {
-				zap.L().Error(fmt.Sprintf("Failed to renew primary domain %s; error %s", t.Name, err.Error()))
-			} else {
-				zap.L().Error(fmt.Sprintf("Failed to renew domain %s; error %s", t.Name, err.Error()))
-			}
+	t.Lock()
+	t.initialized = true
+	t.Unlock()
 
-			t.startServer()
+	t.wg.Add(1)
 
-		},
+	if logger.Trace {
+		zap.L().Debug("t.wg.Add(1)")
+	}
+
+	go t.ocspRoutine(ctx)
+
+	if t.variant != nil {
+		variantErr := t.variant.init(ctx)
+		if variantErr != nil {
+			zap.L().Error(fmt.Sprintf("Processing domain %s %s certificate had error %s", t.Name, string(t.variant.keyType.GetKeyAlgorithm()), variantErr.Error()))
+			if err == nil {
+				err = variantErr
+			}
+		}
 	}
 
-	cfg.Domains = append(cfg.Domains, t.Name)
+	return err
+}
+
+// renew obtains a new certificate if there is no certificate, the certificate
+// expires within the renewal window or the certificate names no longer match
+// the configured names
+func (t *DomainWrapper) renew() error {
+
+	t.renewMutex.Lock()
+	defer t.renewMutex.Unlock()
+
+	// needsRenewal returns the reason the certificate needs to be renewed or an
+	// empty string if it does not
+	needsRenewal := func() string {
+
+		cr, _ := t.get()
+		if cr == nil {
+			return "no certificate"
+		}
+
+		x509Cert, err := parseCertificate(cr)
+		if err != nil {
+			return fmt.Sprintf("invalid certificate; error %s", err.Error())
+		}
+
+		if reason := t.getRevoked(types.GetSerial(x509Cert)); reason != "" {
+			return reason
+		}
+
+		if t.domainsChanged(x509Cert) {
+			return "names changed"
+		}
+
+		keyType := types.GetKeyType(x509Cert)
+		if keyType != t.getKeyType() {
+			return fmt.Sprintf("key type changed from %s to %s", string(keyType), string(t.getKeyType()))
+		}
+
+		if hasMustStaple(x509Cert) != t.getMustStaple() {
+			return "must staple changed"
+		}
+
+		timeLeft := time.Until(x509Cert.NotAfter)
+		zap.L().Debug(fmt.Sprintf("Domain %s certificate expires in %d hours", t.Name, int(timeLeft.Hours())))
+
+		renewBefore := t.getRenewalWindow(x509Cert)
+
+		if timeLeft <= renewBefore {
+			return fmt.Sprintf("certificate expires in %d hours which is within the renewal window of %d hours", int(timeLeft.Hours()), int(renewBefore.Hours()))
+		}
 
-	if len(t.Aliases) > 0 {
-		cfg.Domains = append(cfg.Domains, t.Aliases...)
+		return t.checkRenewalInfo(x509Cert)
 	}
 
-	if logger.Trace {
-		zap.L().Debug(fmt.Sprintf("Initializing SimpleCert for domain %s", t.Name))
+	reason := needsRenewal()
+	if reason == "" {
+		return nil
 	}
 
-	t.wg.Add(1)
+	zap.L().Info(fmt.Sprintf("Renewing domain %s; reason %s", t.Name, reason))
 
-	if logger.Trace {
-		zap.L().Debug("t.wg.Add(1)")
+	err := t.checkRateLimits()
+	if err != nil {
+		t.setErr(err)
+		zap.L().Warn(fmt.Sprintf("Domain %s renewal refused; %s", t.Name, err.Error()))
+		return err
 	}
 
-	_, err := simplecert.Init(cfg, func() {
+	cr, chains, err := t.obtain()
+
+	t.recordIssuance(err)
+
+	if err != nil {
+
+		t.setErr(err)
+
+		if t.Name == t.primaryDomain {
+			zap.L().Error(fmt.Sprintf("Failed to renew primary domain %s; error %s", t.Name, err.Error()))
+		} else {
+			zap.L().Error(fmt.Sprintf("Failed to renew domain %s; error %s", t.Name, err.Error()))
+		}
+
+		return err
+	}
+
+	t.Lock()
+	t.cr = cr
+	t.chains = chains
+	t.ocsp = nil
+	t.ocspResponse = nil
+	t.err = nil
+	t.renewalInfo = nil
+	t.renewalTime = time.Time{}
+	t.lastRenewal = time.Now()
+	t.renewalReason = reason
+	t.revokedSerial = ""
+	t.revokedReason = ""
+	t.Unlock()
+
+	zap.L().Info(fmt.Sprintf("Renewed domain %s; reason %s", t.Name, reason))
+
+	t.updateServedCertificate(cr)
+
+	t.refreshOCSP()
+
+	return nil
+}
+
+func (t *DomainWrapper) renewalRoutine(ctx context.Context, delay time.Duration) {
+
+	defer func() {
 
 		if logger.Trace {
 			zap.L().Debug("t.wg.Done()")
@@ -127,278 +262,1553 @@ func (t *DomainWrapper) init() error {
 
 		t.wg.Done()
 
-		zap.L().Debug(fmt.Sprintf("Closing SimpleCert for domain %s", t.Name))
-	})
+		zap.L().Debug(fmt.Sprintf("Closing renewal for domain %s", t.Name))
+	}()
+
+	for {
+
+		delay = t.getRenewalTimeDelay(delay)
+		delay = t.getRenewalInfoDelay(delay)
+
+		nextCheck := time.Now().Add(delay)
+
+		t.Lock()
+		t.nextCheck = nextCheck
+		t.Unlock()
+
+		zap.L().Debug(fmt.Sprintf("Domain %s next check is at %s", t.Name, nextCheck.Format(time.RFC3339)))
+
+		timer := time.NewTimer(delay)
+
+		select {
+
+		case <-ctx.Done():
+			timer.Stop()
+			return
+
+		case <-timer.C:
+			delay = t.getNextDelay(t.renew())
+
+		case <-t.reissue:
+			timer.Stop()
+			delay = t.getNextDelay(t.renew())
+
+		}
+	}
+}
+
+// getNextDelay returns the delay until the next check. After a failed renewal
+// the check is retried with an exponential backoff starting at RetryInterval
+// and limited to the check interval
+func (t *DomainWrapper) getNextDelay(err error) time.Duration {
+
+	checkInterval := t.getCheckInterval()
+
+	t.Lock()
+	defer t.Unlock()
+
+	if err == nil {
+		t.failures = 0
+		return checkInterval + t.getJitterDelay()
+	}
+
+	// A renewal refused by the ledger is deferred until the limit allows it
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		delay := time.Until(rateLimitErr.RetryAt)
+		if delay < t.retryInterval {
+			delay = t.retryInterval
+		}
+		return delay
+	}
+
+	t.failures++
+
+	delay := t.retryInterval
+	for i := 1; i < t.failures && delay < checkInterval; i++ {
+		delay = delay * 2
+	}
+
+	if delay > checkInterval {
+		delay = checkInterval
+	}
+
+	zap.L().Info(fmt.Sprintf("Domain %s renewal failed %d times; retrying in %s", t.Name, t.failures, delay.String()))
+
+	return delay
+}
+
+// isStale returns true if the certificate has expired or should already have
+// been renewed
+func (t *DomainWrapper) isStale(x509Cert *x509.Certificate) bool {
+	return time.Now().After(x509Cert.NotAfter.Add(-t.getRenewalWindow(x509Cert)))
+}
+
+func (t *DomainWrapper) getRenewBefore() time.Duration {
+	if t.Domain.RenewBefore > 0 {
+		return t.Domain.RenewBefore
+	}
+	return t.Server.renewBefore
+}
+
+func (t *DomainWrapper) getRenewRatio() float64 {
+	if t.Domain.RenewRatio > 0 {
+		return t.Domain.RenewRatio
+	}
+	return t.Server.renewRatio
+}
+
+// getRenewalWindow returns the time before expiry at which the certificate is
+// renewed. This is RenewBefore or RenewRatio of the certificate lifetime,
+// whichever is shorter, so that short lived certificates are not renewed on
+// every check
+func (t *DomainWrapper) getRenewalWindow(x509Cert *x509.Certificate) time.Duration {
+
+	renewBefore := t.getRenewBefore()
+
+	lifetime := x509Cert.NotAfter.Sub(x509Cert.NotBefore)
+	proportional := time.Duration(float64(lifetime) * t.getRenewRatio())
+
+	if proportional > 0 && proportional < renewBefore {
+		return proportional
+	}
 
+	return renewBefore
+}
+
+// getRenewalTimeDelay returns the delay shortened to the time the certificate
+// enters its renewal window if that is sooner. A certificate already in its
+// renewal window is retried at the normal check interval
+func (t *DomainWrapper) getRenewalTimeDelay(delay time.Duration) time.Duration {
+
+	cr, _ := t.get()
+	if cr == nil {
+		return delay
+	}
+
+	x509Cert, err := parseCertificate(cr)
 	if err != nil {
-		t.err = err
-		zap.L().Error(fmt.Sprintf("Processing domain %s had error %s", t.Name, err.Error()))
-		return err
+		return delay
+	}
+
+	until := time.Until(x509Cert.NotAfter.Add(-t.getRenewalWindow(x509Cert)))
+	if until > 0 && until < delay {
+		return until
+	}
+
+	return delay
+}
+
+func (t *DomainWrapper) getCheckInterval() time.Duration {
+	if t.Domain.CheckInterval > 0 {
+		return t.Domain.CheckInterval
+	}
+	return t.Server.checkInterval
+}
+
+// getJitterDelay returns a random duration between zero and the jitter
+func (t *DomainWrapper) getJitterDelay() time.Duration {
+
+	jitter := t.Server.jitter
+	if t.Domain.Jitter > 0 {
+		jitter = t.Domain.Jitter
+	}
+
+	if jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+func (t *DomainWrapper) getStatus() *DomainStatus {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	status := &DomainStatus{
+		Name:          t.Name,
+		KeyType:       t.keyType,
+		NextCheck:     t.nextCheck,
+		Profile:       t.getProfile(),
+		LastRenewal:   t.lastRenewal,
+		RenewalReason: t.renewalReason,
+	}
+
+	if t.ocspResponse != nil {
+		status.OCSPStatus = getOCSPStatus(t.ocspResponse)
+		status.OCSPNextUpdate = t.ocspResponse.NextUpdate
+	}
+
+	if t.renewalInfo != nil {
+		status.SuggestedWindowStart = t.renewalInfo.SuggestedWindow.Start
+		status.SuggestedWindowEnd = t.renewalInfo.SuggestedWindow.End
+	}
+
+	if t.cr != nil {
+		x509Cert, err := parseCertificate(t.cr)
+		if err == nil {
+			status.NotAfter = x509Cert.NotAfter
+			status.Serial = types.GetSerial(x509Cert)
+			status.Stale = t.isStale(x509Cert)
+		}
+	}
+
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+
+	status.Degraded = status.Stale || (t.cr != nil && t.err != nil)
+	status.Ready = t.cr != nil
+	status.Initialized = t.initialized
+
+	return status
+}
+
+// isReady returns true once the domain has a certificate
+func (t *DomainWrapper) isReady() bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.cr != nil
+}
+
+func (t *DomainWrapper) setErr(err error) {
+	t.Lock()
+	defer t.Unlock()
+	t.err = err
+}
+
+// getForKeyAlgorithm returns the domain or its variant with the key algorithm.
+// If the key algorithm is empty the domain is returned
+func (t *DomainWrapper) getForKeyAlgorithm(keyAlgorithm KeyAlgorithm) *DomainWrapper {
+
+	if keyAlgorithm == types.KeyAlgorithmEmpty || t.keyType.GetKeyAlgorithm() == keyAlgorithm {
+		return t
+	}
+
+	if t.variant != nil && t.variant.keyType.GetKeyAlgorithm() == keyAlgorithm {
+		return t.variant
+	}
+
+	return nil
+}
+
+func (t *DomainWrapper) get() (*CR, error) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.cr, t.err
+}
+
+// servedCertificate is the certificate served by the API listener
+type servedCertificate struct {
+	cert     *tls.Certificate
+	serial   string
+	notAfter time.Time
+}
+
+type Server struct {
+	primaryDomain        string
+	domains              map[string]*DomainWrapper
+	email                string
+	cacheDir             string
+	directoryURL         string
+	caBundle             string
+	keyType              KeyType
+	profile              string
+	renewBefore          time.Duration
+	renewRatio           float64
+	checkInterval        time.Duration
+	jitter               time.Duration
+	retryInterval        time.Duration
+	degradedStartup      bool
+	mustStaple           bool
+	ocspResponder        string
+	ocspInterval         time.Duration
+	listenAddress        string
+	httpChallengeAddress string
+	tlsChallengeAddress  string
+
+	externalAccountBinding *ExternalAccountBinding
+	solver                 *solver
+	servedCertificate      atomic.Pointer[servedCertificate]
+	secret                 string
+	adminSecret            string
+	clientCAs              *x509.CertPool
+	auth                   *authServer
+	identities             *identityStore
+	mutex                  sync.Mutex
+	accountMutex           sync.Mutex
+	cancel                 context.CancelFunc
+	errc                   chan error
+	initWorkers            int
+	ledger                 *ledger
+	guard                  *authGuard
+	wg                     sync.WaitGroup
+}
+
+func New(config *Config) (*Server, error) {
+
+	if logger.Trace {
+		zap.L().Debug("New(config *Config) (*Server, error)")
+	}
+
+	if config == nil {
+		panic("config is nil")
+	}
+
+	config = config.Clone()
+
+	if config.PrimaryDomain == nil {
+		return nil, fmt.Errorf("primary domain is required")
+	}
+
+	if config.Email == "" {
+		return nil, fmt.Errorf("email is required")
+	}
+
+	if config.CacheDir == "" {
+		config.CacheDir = DefaultCacheDir
+	}
+
+	if config.DirectoryURL == "" {
+		config.DirectoryURL = DefaultDirectoryURL
+	}
+
+	if config.RenewBefore < 0 || config.CheckInterval < 0 || config.Jitter < 0 {
+		return nil, fmt.Errorf("renewBefore, checkInterval and jitter must not be negative")
+	}
+
+	if config.RenewBefore == 0 {
+		config.RenewBefore = DefaultRenewBefore
+	}
+
+	if config.RenewRatio < 0 || config.RenewRatio >= 1 {
+		return nil, fmt.Errorf("renewRatio must be between 0 and 1")
+	}
+
+	if config.RenewRatio == 0 {
+		config.RenewRatio = DefaultRenewRatio
+	}
+
+	if config.CheckInterval == 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+
+	if config.Jitter == 0 {
+		config.Jitter = DefaultJitter
+	}
+
+	if config.InitWorkers < 0 {
+		return nil, fmt.Errorf("initWorkers must not be negative")
+	}
+
+	if config.InitWorkers == 0 {
+		config.InitWorkers = DefaultInitWorkers
+	}
+
+	if config.RetryInterval < 0 {
+		return nil, fmt.Errorf("retryInterval must not be negative")
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+
+	if config.OCSPInterval < 0 {
+		return nil, fmt.Errorf("ocspInterval must not be negative")
+	}
+
+	if config.OCSPInterval == 0 {
+		config.OCSPInterval = DefaultOCSPInterval
+	}
+
+	if config.RateLimits == nil {
+		config.RateLimits = &RateLimits{}
+	}
+
+	rateLimits := config.RateLimits
+
+	if rateLimits.CertificatesPerDomain < 0 || rateLimits.DuplicateCertificates < 0 || rateLimits.FailedValidations < 0 ||
+		rateLimits.CertificatesPerDomainWindow < 0 || rateLimits.DuplicateCertificatesWindow < 0 || rateLimits.FailedValidationsWindow < 0 {
+		return nil, fmt.Errorf("rateLimits must not be negative")
+	}
+
+	if rateLimits.CertificatesPerDomain == 0 {
+		rateLimits.CertificatesPerDomain = DefaultCertificatesPerDomain
+	}
+
+	if rateLimits.CertificatesPerDomainWindow == 0 {
+		rateLimits.CertificatesPerDomainWindow = DefaultCertificatesPerDomainWindow
+	}
+
+	if rateLimits.DuplicateCertificates == 0 {
+		rateLimits.DuplicateCertificates = DefaultDuplicateCertificates
+	}
+
+	if rateLimits.DuplicateCertificatesWindow == 0 {
+		rateLimits.DuplicateCertificatesWindow = DefaultDuplicateCertificatesWindow
+	}
+
+	if rateLimits.FailedValidations == 0 {
+		rateLimits.FailedValidations = DefaultFailedValidations
 	}
 
-	return load()
-}
+	if rateLimits.FailedValidationsWindow == 0 {
+		rateLimits.FailedValidationsWindow = DefaultFailedValidationsWindow
+	}
+
+	if config.AuthLimits == nil {
+		config.AuthLimits = &AuthLimits{}
+	}
+
+	authLimits := config.AuthLimits
+
+	if authLimits.Requests < 0 || authLimits.IdentityRequests < 0 || authLimits.Window < 0 || authLimits.Lockout < 0 || authLimits.MaxLockout < 0 {
+		return nil, fmt.Errorf("authLimits must not be negative")
+	}
+
+	if authLimits.Requests == 0 {
+		authLimits.Requests = DefaultAuthRequests
+	}
+
+	if authLimits.IdentityRequests == 0 {
+		authLimits.IdentityRequests = DefaultAuthIdentityRequests
+	}
+
+	if authLimits.Window == 0 {
+		authLimits.Window = DefaultAuthWindow
+	}
+
+	if authLimits.Lockout == 0 {
+		authLimits.Lockout = DefaultAuthLockout
+	}
+
+	if authLimits.MaxLockout == 0 {
+		authLimits.MaxLockout = DefaultAuthMaxLockout
+	}
+
+	if authLimits.MaxLockout < authLimits.Lockout {
+		return nil, fmt.Errorf("authLimits maxLockout must not be less than lockout")
+	}
+
+	if config.ListenAddress == "" {
+		config.ListenAddress = DefaultListenAddress
+	}
+
+	if config.HTTPChallengeAddress == "" {
+		config.HTTPChallengeAddress = DefaultHTTPChallengeAddress
+	}
+
+	if config.TLSChallengeAddress == "" {
+		config.TLSChallengeAddress = DefaultTLSChallengeAddress
+	}
+
+	for _, address := range []string{config.ListenAddress, config.HTTPChallengeAddress, config.TLSChallengeAddress} {
+		_, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("address %s is invalid; %w", address, err)
+		}
+	}
+
+	// The tls-alpn-01 challenge may share the API address as the API listener
+	// answers it
+	if addressesConflict(config.HTTPChallengeAddress, config.ListenAddress) {
+		return nil, fmt.Errorf("httpChallengeAddress %s conflicts with listenAddress %s", config.HTTPChallengeAddress, config.ListenAddress)
+	}
+
+	if addressesConflict(config.HTTPChallengeAddress, config.TLSChallengeAddress) {
+		return nil, fmt.Errorf("httpChallengeAddress %s conflicts with tlsChallengeAddress %s", config.HTTPChallengeAddress, config.TLSChallengeAddress)
+	}
+
+	err := validateExternalAccountBinding(config.ExternalAccountBinding)
+	if err != nil {
+		return nil, err
+	}
+
+	guard, err := newAuthGuard(authLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	keyType := types.KeyTypeFromString(config.KeyType)
+
+	switch keyType {
+
+	case types.KeyTypeEmpty:
+		keyType = DefaultKeyType
+
+	case types.KeyTypeUnknown:
+		return nil, fmt.Errorf("key type %s is not supported", config.KeyType)
+
+	}
+
+	s := &Server{
+		domains:       make(map[string]*DomainWrapper),
+		secret:        config.Secret,
+		errc:          make(chan error, 10),
+		email:         config.Email,
+		primaryDomain: config.PrimaryDomain.Name,
+		cacheDir:      config.CacheDir,
+		directoryURL:  getDirectoryURL(config.DirectoryURL),
+		caBundle:      config.CABundle,
+		keyType:       keyType,
+		profile:       config.Profile,
+		renewBefore:   config.RenewBefore,
+		renewRatio:    config.RenewRatio,
+		checkInterval: config.CheckInterval,
+		jitter:        config.Jitter,
+		retryInterval: config.RetryInterval,
+		initWorkers:   config.InitWorkers,
+		mustStaple:    config.MustStaple,
+		ocspResponder: config.OCSPResponder,
+		ocspInterval:  config.OCSPInterval,
+
+		listenAddress:        config.ListenAddress,
+		httpChallengeAddress: config.HTTPChallengeAddress,
+		tlsChallengeAddress:  config.TLSChallengeAddress,
+
+		degradedStartup:        config.DegradedStartup,
+		externalAccountBinding: config.ExternalAccountBinding,
+		solver:                 newSolver(config.ListenAddress),
+		ledger:                 newLedger(filepath.Join(config.CacheDir, LedgerFileName), rateLimits),
+		guard:                  guard,
+	}
+
+	addDomain := func(domain *Domain) error {
+
+		if domain.Name == "" {
+			return fmt.Errorf("Domain is required")
+		}
+
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("Adding domain %s", domain.Name))
+		}
+
+		var names []string
+		names = append(names, domain.Name)
+		names = append(names, domain.Aliases...)
+
+		wildcard := false
+
+		for _, name := range names {
+
+			err := validateDomainName(name)
+			if err != nil {
+				return fmt.Errorf("domain %s: %w", domain.Name, err)
+			}
+
+			if isWildcard(name) {
+				wildcard = true
+			}
+		}
+
+		if domain.Secret == "" && s.secret == "" && len(config.Identities) == 0 {
+			return fmt.Errorf("domain %s: secret is required when the global secret is not set and there are no identities", domain.Name)
+		}
+
+		if _, exist := s.domains[domain.Name]; exist {
+			return fmt.Errorf("domain %s is configured more than once", domain.Name)
+		}
+
+		if domain.Challenge != nil {
+
+			switch ChallengeTypeFromString(domain.Challenge.Type) {
+
+			case ChallengeTypeEmpty, ChallengeTypeHTTP:
+
+				if domain.Challenge.Webroot != "" && domain.Challenge.HTTPAddress != "" {
+					return fmt.Errorf("domain %s: challenge webroot and httpAddress are mutually exclusive", domain.Name)
+				}
+
+				if domain.Challenge.HTTPAddress != "" {
+
+					_, _, err := net.SplitHostPort(domain.Challenge.HTTPAddress)
+					if err != nil {
+						return fmt.Errorf("domain %s: challenge httpAddress %s is invalid; %w", domain.Name, domain.Challenge.HTTPAddress, err)
+					}
+
+					if addressesConflict(domain.Challenge.HTTPAddress, s.listenAddress) {
+						return fmt.Errorf("domain %s: challenge httpAddress %s conflicts with listenAddress %s", domain.Name, domain.Challenge.HTTPAddress, s.listenAddress)
+					}
+
+					// The challenge listener is shared by address so an equal address is not a conflict
+					if domain.Challenge.HTTPAddress != s.httpChallengeAddress && addressesConflict(domain.Challenge.HTTPAddress, s.httpChallengeAddress) {
+						return fmt.Errorf("domain %s: challenge httpAddress %s conflicts with httpChallengeAddress %s", domain.Name, domain.Challenge.HTTPAddress, s.httpChallengeAddress)
+					}
+
+					if addressesConflict(domain.Challenge.HTTPAddress, s.tlsChallengeAddress) {
+						return fmt.Errorf("domain %s: challenge httpAddress %s conflicts with tlsChallengeAddress %s", domain.Name, domain.Challenge.HTTPAddress, s.tlsChallengeAddress)
+					}
+				}
+
+			case ChallengeTypeDNS:
+				if domain.Challenge.Provider == "" {
+					return fmt.Errorf("domain %s: challenge provider is required for %s", domain.Name, string(ChallengeTypeDNS))
+				}
+
+			default:
+				return fmt.Errorf("domain %s: challenge type %s is not supported", domain.Name, domain.Challenge.Type)
+
+			}
+		}
+
+		err := validateExternalAccountBinding(domain.ExternalAccountBinding)
+		if err != nil {
+			return fmt.Errorf("domain %s: %w", domain.Name, err)
+		}
+
+		if domain.RenewBefore < 0 || domain.CheckInterval < 0 || domain.Jitter < 0 {
+			return fmt.Errorf("domain %s: renewBefore, checkInterval and jitter must not be negative", domain.Name)
+		}
+
+		if domain.RenewRatio < 0 || domain.RenewRatio >= 1 {
+			return fmt.Errorf("domain %s: renewRatio must be between 0 and 1", domain.Name)
+		}
+
+		keyType := types.KeyTypeFromString(domain.KeyType)
+
+		switch keyType {
+
+		case types.KeyTypeEmpty:
+			keyType = s.keyType
+
+		case types.KeyTypeUnknown:
+			return fmt.Errorf("domain %s: key type %s is not supported", domain.Name, domain.KeyType)
+
+		}
+
+		if domain.CABundle != "" {
+			_, err := loadCABundle(domain.CABundle)
+			if err != nil {
+				return fmt.Errorf("domain %s: %w", domain.Name, err)
+			}
+		}
+
+		wrapper := &DomainWrapper{
+			Domain:  domain,
+			Server:  s,
+			keyType: keyType,
+			reissue: make(chan struct{}, 1),
+		}
+
+		// A dual domain keeps a certificate with the other key algorithm. The server
+		// key type is used if it is of that algorithm otherwise the default is used.
+		if domain.Dual {
+
+			variantKeyType := DefaultECDSAKeyType
+			if keyType.GetKeyAlgorithm() == types.KeyAlgorithmECDSA {
+				variantKeyType = DefaultRSAKeyType
+			}
+
+			if s.keyType.GetKeyAlgorithm() == variantKeyType.GetKeyAlgorithm() {
+				variantKeyType = s.keyType
+			}
+
+			wrapper.variant = &DomainWrapper{
+				Domain:  domain,
+				Server:  s,
+				keyType: variantKeyType,
+				certDir: filepath.Join(s.cacheDir, getCacheDirName(domain.Name), string(variantKeyType.GetKeyAlgorithm())),
+				reissue: make(chan struct{}, 1),
+			}
+		}
+
+		if wildcard && wrapper.getChallengeType() != ChallengeTypeDNS {
+			return fmt.Errorf("domain %s: wildcard names require the %s challenge", domain.Name, string(ChallengeTypeDNS))
+		}
+
+		s.domains[domain.Name] = wrapper
+
+		return nil
+	}
+
+	if config.CABundle != "" {
+		_, err := loadCABundle(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AdminSecret != "" {
+		s.adminSecret, err = resolveCredential(config.AdminSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve adminSecret; %w", err)
+		}
+	}
+
+	if config.ClientCA != "" {
+		s.clientCAs, err = loadCABundle(config.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("client CA: %w", err)
+		}
+	}
+
+	err = addDomain(config.PrimaryDomain)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, domain := range config.Domains {
+		err := addDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.adminSecret != "" {
+
+		if s.adminSecret == s.secret {
+			return nil, fmt.Errorf("adminSecret must not be the same as secret")
+		}
+
+		for _, domain := range s.domains {
+			if s.adminSecret == domain.Secret {
+				return nil, fmt.Errorf("adminSecret must not be the same as the secret of domain %s", domain.Name)
+			}
+		}
+	}
+
+	s.auth = newAuthServer(s.secret, s.adminSecret, s.getSortedDomains())
+
+	s.identities, err = newIdentityStore(filepath.Join(s.cacheDir, IdentitiesFileName), s.auth, s.domains, config.Identities)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func validateExternalAccountBinding(eab *ExternalAccountBinding) error {
+
+	if eab == nil {
+		return nil
+	}
+
+	if eab.KeyID == "" {
+		return fmt.Errorf("external account binding keyId is required")
+	}
+
+	if eab.HMACKey == "" {
+		return fmt.Errorf("external account binding hmacKey is required")
+	}
+
+	return nil
+}
+
+// addressesConflict returns true if both addresses can not be listened on at the
+// same time. This is the case if the ports are equal and the hosts are equal or
+// either host is unspecified
+func addressesConflict(a, b string) bool {
+
+	hostA, portA, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+
+	hostB, portB, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+
+	if portA != portB {
+		return false
+	}
+
+	isUnspecified := func(host string) bool {
+		if host == "" {
+			return true
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsUnspecified()
+	}
+
+	if isUnspecified(hostA) || isUnspecified(hostB) {
+		return true
+	}
+
+	return strings.EqualFold(hostA, hostB)
+}
+
+func (t *Server) Run(ctx context.Context) error {
+
+	if logger.Trace {
+		zap.L().Debug("func (t *Server) Run(ctx context.Context) error")
+	}
+
+	ctx, cancelCtx := context.WithCancel(ctx)
+
+	defer func() {
+		if logger.Trace {
+			zap.L().Debug("defer")
+		}
+		cancelCtx()
+		t.stopServer()
+		close(t.errc)
+	}()
+
+	err := t.startServer()
+	if err != nil {
+		return err
+	}
+
+	zap.L().Debug("Processing Domains")
+
+	primaryDomain := t.domains[t.primaryDomain]
+
+	var domains []*DomainWrapper
+	for _, domain := range t.getSortedDomains() {
+		if domain != primaryDomain {
+			domains = append(domains, domain)
+		}
+	}
+
+	// On a degraded startup the cached certificates are served immediately and
+	// the domains without one, including the primary domain, are obtained in
+	// the background. Otherwise the primary domain must have a certificate
+	// before the other domains are processed.
+	if t.degradedStartup {
+
+		zap.L().Info("Degraded startup; serving cached certificates")
+
+		domains = append([]*DomainWrapper{primaryDomain}, domains...)
+
+	} else {
+
+		err = primaryDomain.init(ctx)
+		if err != nil {
+			return err
+		}
+
+		if primaryDomain.err != nil {
+			return fmt.Errorf("failed to process primary domain; had error %s", primaryDomain.err.Error())
+		}
+	}
+
+	// Each domain is served as soon as it has a certificate so the API does not
+	// wait for every domain to be processed
+	t.wg.Add(1)
+
+	if logger.Trace {
+		zap.L().Debug("t.wg.Add(1)")
+	}
+
+	go t.initDomains(ctx, domains)
+
+	go func() {
+		<-ctx.Done()
+		t.errc <- nil
+	}()
+
+	if logger.Trace {
+		zap.L().Debug("t.wg.Wait()")
+	}
+
+	t.wg.Wait()
+
+	return <-t.errc
+}
+
+// startServer starts the API listener. It is started before the domains are
+// processed so that it can answer the tls-alpn-01 challenge on its address and
+// is not stopped until the server is shut down. A domain is refused by /getcert
+// until it is ready
+func (t *Server) startServer() error {
+
+	if logger.Trace {
+		zap.L().Debug("func (t *Server) startServer()")
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.cancel != nil {
+		if logger.Trace {
+			zap.L().Debug("Server is already running")
+		}
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", t.listenAddress)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+
+	httpServer := &http.Server{
+		Addr:    t.listenAddress,
+		Handler: t,
+		TLSConfig: &tls.Config{
+			GetCertificate: t.getCertificate,
+			NextProtos:     []string{tlsalpn01.ACMETLS1Protocol},
+			// A client certificate is verified by the handler against the client CA
+			// or the identity SPKI so a client without one can still use a token
+			ClientAuth: tls.RequestClientCert,
+		},
+	}
+
+	sendErr := func(err error) {
+		if err != nil {
+			if err == http.ErrServerClosed {
+				return
+			}
+			t.errc <- err
+		}
+	}
+
+	go func() {
+		zap.L().Debug("Starting ServeTLS : blocking")
+		err := httpServer.ServeTLS(listener, "", "")
+		zap.L().Debug("Stopping ServeTLS : not blocking")
+		sendErr(err)
+		cancel()
+	}()
+
+	go func() {
+
+		if logger.Trace {
+			zap.L().Debug("blocking start")
+		}
+
+		<-ctx.Done()
+
+		if logger.Trace {
+			zap.L().Debug("blocking end")
+		}
+
+		zap.L().Debug("Shutting down ServeTLS")
+		ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancelShutdown()
+		sendErr(httpServer.Shutdown(ctxShutdown))
+		zap.L().Debug("ServeTLS shut down")
+	}()
+
+	return nil
+}
+
+// getCertificate returns the tls-alpn-01 challenge certificate for a challenge
+// and otherwise the primary domain certificate
+func (t *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	if isTLSALPNChallenge(hello) {
+		return t.solver.getTLSCertificate(hello)
+	}
+
+	served := t.servedCertificate.Load()
+	if served == nil {
+		return nil, fmt.Errorf("primary domain %s does not have a certificate", t.primaryDomain)
+	}
+
+	return served.cert, nil
+}
+
+// setServedCertificate parses the certificate and swaps it in as the API
+// certificate. New connections use it immediately and established connections
+// are not affected
+func (t *Server) setServedCertificate(cr *CR) error {
+
+	cert, err := tls.X509KeyPair(cr.Certificate, cr.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	x509Cert, err := parseCertificate(cr)
+	if err != nil {
+		return err
+	}
+
+	t.servedCertificate.Store(&servedCertificate{
+		cert:     &cert,
+		serial:   types.GetSerial(x509Cert),
+		notAfter: x509Cert.NotAfter,
+	})
+
+	zap.L().Info(fmt.Sprintf("API is now serving certificate serial %s", types.GetSerial(x509Cert)))
+
+	return nil
+}
+
+// updateServedCertificate sets the API certificate if the domain is the primary domain
+func (t *DomainWrapper) updateServedCertificate(cr *CR) {
+
+	if t.Server.domains[t.primaryDomain] != t {
+		return
+	}
+
+	err := t.setServedCertificate(cr)
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Failed to set API certificate from primary domain %s; error %s", t.Name, err.Error()))
+	}
+}
+
+// initDomains processes the domains concurrently with at most initWorkers at a time
+func (t *Server) initDomains(ctx context.Context, domains []*DomainWrapper) {
+
+	defer func() {
+
+		if logger.Trace {
+			zap.L().Debug("t.wg.Done()")
+		}
+
+		t.wg.Done()
+	}()
+
+	workers := make(chan struct{}, t.initWorkers)
+
+	var wg sync.WaitGroup
+
+	for _, domain := range domains {
+
+		wg.Add(1)
+
+		go func(domain *DomainWrapper) {
+
+			defer wg.Done()
+
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			defer func() { <-workers }()
+
+			domain.init(ctx)
+
+			if domain.isReady() {
+				zap.L().Info(fmt.Sprintf("Domain %s is ready", domain.Name))
+			}
+
+		}(domain)
+	}
+
+	wg.Wait()
+
+	zap.L().Debug("Processing Domains Completed")
+}
+
+func (t *Server) stopServer() {
+
+	if logger.Trace {
+		zap.L().Debug("stopServer()")
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.cancel == nil {
+		zap.L().Debug("Server is not running")
+		return
+	}
+
+	t.cancel()
+	t.cancel = nil
+}
+
+// getSortedDomains returns the domains sorted by name
+func (t *Server) getSortedDomains() []*DomainWrapper {
+
+	var names []string
+	for name := range t.domains {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var domains []*DomainWrapper
+	for _, name := range names {
+		domains = append(domains, t.domains[name])
+	}
+
+	return domains
+}
+
+// findDomain returns the domain with the name. If there is none then the first
+// domain with an alias equal to the name is returned and if there is none then
+// the first domain with a wildcard covering the name is returned
+func (t *Server) findDomain(name string) *DomainWrapper {
+
+	domain := t.domains[name]
+	if domain != nil {
+		return domain
+	}
+
+	domains := t.getSortedDomains()
+
+	for _, domain := range domains {
+		for _, alias := range domain.Aliases {
+			if strings.EqualFold(alias, name) {
+				return domain
+			}
+		}
+	}
+
+	for _, domain := range domains {
+		if domain.covers(name) {
+			return domain
+		}
+	}
+
+	return nil
+}
+
+// getStatus returns the status of every domain certificate sorted by domain name
+func (t *Server) getStatus() []*DomainStatus {
+
+	var domains []*DomainStatus
+
+	for _, domain := range t.getSortedDomains() {
+		domains = append(domains, domain.getStatus())
+		if domain.variant != nil {
+			domains = append(domains, domain.variant.getStatus())
+		}
+	}
+
+	return domains
+}
+
+func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// authorize validates the bearer token, or the client certificate if there is
+	// no bearer token, and returns the token or the error message if the request
+	// is not authorized. Admin requests require a token issued for the admin
+	// secret or an admin identity
+	authorize := func(admin bool) (*authToken, string) {
+
+		var token *authToken
+		var err error
+
+		authHeader := r.Header.Get("Authorization")
+		bearerToken := strings.TrimPrefix(authHeader, PrefixBearer)
+
+		switch {
+
+		case bearerToken != "":
+			token, err = t.auth.validateToken(bearerToken)
+
+		case r.TLS != nil && len(r.TLS.PeerCertificates) > 0:
+			token, err = t.getTokenFromClientCertificate(r.TLS.PeerCertificates)
+
+		default:
+			zap.L().Debug("bearerToken not found")
+			return nil, "bearerToken not found"
+
+		}
+
+		if err != nil {
+			zap.L().Debug(fmt.Sprintf("Request %s from %s is not authorized; %s", r.URL.Path, r.RemoteAddr, err.Error()))
+			return nil, err.Error()
+		}
+
+		if admin && !token.admin {
+			zap.L().Debug(fmt.Sprintf("Token is not valid for admin request %s", r.URL.Path))
+			return nil, "token is not valid for admin requests"
+		}
+
+		return token, ""
+	}
+
+	// requirePost returns the error message if the request is not a POST
+	requirePost := func() string {
+		if r.Method != http.MethodPost {
+			message := fmt.Sprintf("method %s is not allowed; use %s", r.Method, http.MethodPost)
+			zap.L().Debug(message)
+			return message
+		}
+		return ""
+	}
+
+	remoteIP := getRemoteIP(r.RemoteAddr)
+
+	serveHTTP := func() any {
+
+		zap.L().Debug(fmt.Sprintf("Handling %s:%s", r.Method, r.URL.Path))
+
+		if err := t.guard.checkAllowed(remoteIP); err != nil {
+			return &SimpleMessage{
+				Message: "see error",
+				Error:   err.Error(),
+			}
+		}
+
+		switch r.URL.Path {
+
+		case "/getauthrequest":
+
+			if err := t.guard.check(guardKindAddress, remoteIP, t.guard.limits.Requests); err != nil {
+				return &SimpleMessage{
+					Message: "see error",
+					Error:   err.Error(),
+				}
+			}
+
+			return t.auth.newRequest()
+
+		case "/getauthtoken":
+
+			response := &TokenResponse{}
+
+			identityParam := r.URL.Query().Get("identity")
+
+			// Only an existing identity is limited so a request for a made up name
+			// does not add an entry and a caller can not lock out a name it does not
+			// know exists. The address limit still applies
+			guardIdentity := ""
+			if identityParam != "" && t.auth.hasIdentity(identityParam) {
+				guardIdentity = identityParam
+			}
+
+			if err := t.guard.check(guardKindAddress, remoteIP, t.guard.limits.Requests); err != nil {
+				response.Error = err.Error()
+				return response
+			}
+
+			if err := t.guard.check(guardKindIdentity, guardIdentity, t.guard.limits.IdentityRequests); err != nil {
+				response.Error = err.Error()
+				return response
+			}
+
+			postBytes, err := io.ReadAll(r.Body)
+			if err != nil {
+				response.Error = err.Error()
+				zap.L().Error(err.Error())
+				return response
+			}
+
+			defer r.Body.Close()
+
+			authRequest := &AuthRequest{}
+			err = json.Unmarshal(postBytes, authRequest)
+
+			if err != nil {
+				response.Error = err.Error()
+				zap.L().Error(err.Error())
+				return response
+			}
+
+			token, err := t.auth.getTokenFromRequest(authRequest, identityParam)
+			if err != nil {
+				t.guard.fail(guardKindAddress, remoteIP)
+				t.guard.fail(guardKindIdentity, guardIdentity)
+				response.Error = err.Error()
+				if identityParam != "" {
+					zap.L().Info(fmt.Sprintf("Identity %s was refused a token from %s; %s", identityParam, r.RemoteAddr, err.Error()))
+				} else if logger.Trace {
+					zap.L().Debug(err.Error())
+				}
+				return response
+			}
+
+			t.guard.succeed(guardKindAddress, remoteIP)
+			t.guard.succeed(guardKindIdentity, guardIdentity)
+
+			zap.L().Debug(fmt.Sprintf("Token issued to %s from %s", token.getName(), r.RemoteAddr))
+
+			response.Token = token.Token
+			response.Identity = token.identity
+			response.Domains = token.domains
+
+			return response
+
+		case "/getstatus":
+
+			response := &StatusResponse{}
+
+			if _, errMessage := authorize(true); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
+
+			response.Domains = t.getStatus()
+
+			if served := t.servedCertificate.Load(); served != nil {
+				response.ServedSerial = served.serial
+				response.ServedNotAfter = served.notAfter
+			}
+
+			return response
+
+		case "/revoke":
+
+			response := &RevokeResponse{}
+
+			if errMessage := requirePost(); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
+
+			if _, errMessage := authorize(true); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
+
+			domainParam := r.URL.Query().Get("domain")
+			if domainParam == "" {
+				response.Error = "domain is required"
+				zap.L().Debug("domain missing from request")
+				return response
+			}
+
+			domain := t.domains[domainParam]
+			if domain == nil {
+				response.Error = "domain not found"
+				zap.L().Debug("domain not found")
+				return response
+			}
+
+			keyAlgorithmParam := r.URL.Query().Get("keyAlgorithm")
+			keyAlgorithm := types.KeyAlgorithmFromString(keyAlgorithmParam)
+
+			if keyAlgorithm == types.KeyAlgorithmUnknown {
+				response.Error = fmt.Sprintf("keyAlgorithm %s is not supported", keyAlgorithmParam)
+				zap.L().Debug(response.Error)
+				return response
+			}
+
+			domain = domain.getForKeyAlgorithm(keyAlgorithm)
+			if domain == nil {
+				response.Error = fmt.Sprintf("domain %s does not have a %s certificate", domainParam, string(keyAlgorithm))
+				zap.L().Debug(response.Error)
+				return response
+			}
+
+			reasonParam := r.URL.Query().Get("reason")
+			reason := types.RevocationReasonFromString(reasonParam)
+
+			switch reason {
+
+			case types.RevocationReasonEmpty:
+				reason = types.RevocationReasonUnspecified
+
+			case types.RevocationReasonUnknown:
+				response.Error = fmt.Sprintf("reason %s is not supported", reasonParam)
+				zap.L().Debug(response.Error)
+				return response
+
+			}
+
+			zap.L().Info(fmt.Sprintf("Revocation requested for domain %s %s certificate; reason %s", domain.Name, string(domain.keyType), string(reason)))
 
-func (t *DomainWrapper) get() (*CR, error) {
-	t.RLock()
-	defer t.RUnlock()
-	return t.cr, t.err
-}
+			result, err := domain.revoke(reason)
+			if result != nil {
+				response = result
+			}
 
-type Server struct {
-	primaryDomain string
-	domains       map[string]*DomainWrapper
-	email         string
-	cacheDir      string
-	hashserver    *hashserver.Server
-	mutex         sync.Mutex
-	cancel        context.CancelFunc
-	errc          chan error
-	embargo       bool
-	wg            sync.WaitGroup
-}
+			if err != nil {
+				response.Error = err.Error()
+				zap.L().Error(fmt.Sprintf("Domain %s revocation had error %s", domain.Name, err.Error()))
+			}
 
-func New(config *Config) (*Server, error) {
+			return response
 
-	if logger.Trace {
-		zap.L().Debug("New(config *Config) (*Server, error)")
-	}
+		case "/getaccounts":
 
-	if config == nil {
-		panic("config is nil")
-	}
+			response := &AccountsResponse{}
 
-	config = config.Clone()
+			if _, errMessage := authorize(true); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-	if config.Secret == "" {
-		return nil, fmt.Errorf("secret is required")
-	}
+			response.Accounts = t.getAccounts()
 
-	if config.PrimaryDomain == nil {
-		return nil, fmt.Errorf("primary domain is required")
-	}
+			return response
 
-	if config.Email == "" {
-		return nil, fmt.Errorf("email is required")
-	}
+		case "/rotateaccountkey", "/updateaccount", "/deactivateaccount":
 
-	if config.CacheDir == "" {
-		config.CacheDir = DefaultCacheDir
-	}
+			response := &AccountResponse{}
 
-	s := &Server{
-		domains: make(map[string]*DomainWrapper),
-		hashserver: hashserver.New(&hashserver.Config{
-			Secret: config.Secret,
-		}),
-		errc:          make(chan error, 10),
-		embargo:       true,
-		email:         config.Email,
-		primaryDomain: config.PrimaryDomain.Name,
-		cacheDir:      config.CacheDir,
-	}
+			if errMessage := requirePost(); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-	addDomain := func(domain *Domain) error {
+			if _, errMessage := authorize(true); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-		if domain.Name == "" {
-			return fmt.Errorf("Domain is required")
-		}
+			domainParam := r.URL.Query().Get("domain")
+			if domainParam == "" {
+				response.Error = "domain is required"
+				zap.L().Debug("domain missing from request")
+				return response
+			}
 
-		if logger.Trace {
-			zap.L().Debug(fmt.Sprintf("Adding domain %s", domain.Name))
-		}
+			domain := t.domains[domainParam]
+			if domain == nil {
+				response.Error = "domain not found"
+				zap.L().Debug("domain not found")
+				return response
+			}
 
-		s.domains[domain.Name] = &DomainWrapper{
-			Domain: domain,
-			Server: s,
-		}
+			var account *Account
+			var err error
 
-		return nil
-	}
+			switch r.URL.Path {
 
-	err := addDomain(config.PrimaryDomain)
-	if err != nil {
-		return nil, err
-	}
+			case "/rotateaccountkey":
+				account, err = domain.rotateAccountKey()
 
-	for _, domain := range config.Domains {
-		err := addDomain(domain)
-		if err != nil {
-			return nil, err
-		}
-	}
+			case "/updateaccount":
+				account, err = domain.updateAccountContacts(r.URL.Query()["email"])
 
-	return s, nil
-}
+			case "/deactivateaccount":
+				account, err = domain.deactivateAccount()
 
-func (t *Server) Run(ctx context.Context) error {
+			}
 
-	if logger.Trace {
-		zap.L().Debug("func (t *Server) Run(ctx context.Context) error")
-	}
+			if err != nil {
+				response.Error = err.Error()
+				zap.L().Error(fmt.Sprintf("Domain %s account request %s had error %s", domain.Name, r.URL.Path, err.Error()))
+				return response
+			}
 
-	ctx, cancelCtx := context.WithCancel(ctx)
+			response.Account = account
 
-	liftEmbargo := func() {
-		t.mutex.Lock()
-		defer t.mutex.Unlock()
-		if logger.Trace {
-			zap.L().Debug("Lifting embargo")
-		}
-		t.embargo = false
-	}
+			return response
 
-	defer func() {
-		if logger.Trace {
-			zap.L().Debug("defer")
-		}
-		cancelCtx()
-		t.stopServer()
-		t.hashserver.Shutdown()
-		close(t.errc)
-	}()
+		case "/getratelimits":
 
-	zap.L().Debug("Processing Domains")
+			response := &RateLimitsResponse{}
 
-	primaryDomain := t.domains[t.primaryDomain]
-	err := primaryDomain.init()
-	if err != nil {
-		return err
-	}
+			if _, errMessage := authorize(true); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-	for _, domain := range t.domains {
-		domain.init()
-	}
+			response.Limits = t.ledger.getHeadroom(t.getSortedDomains())
 
-	zap.L().Debug("Processing Domains Completed")
+			return response
 
-	if primaryDomain.err != nil {
-		return fmt.Errorf("failed to process primary domain; had error %s", primaryDomain.err.Error())
-	}
+		case "/getidentities":
 
-	liftEmbargo()
-	t.startServer()
+			response := &ClientIdentitiesResponse{}
 
-	go func() {
-		<-ctx.Done()
-		t.errc <- nil
-	}()
+			if _, errMessage := authorize(true); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-	if logger.Trace {
-		zap.L().Debug("t.wg.Wait()")
-	}
+			response.Identities = t.identities.getIdentities()
 
-	t.wg.Wait()
+			return response
 
-	return <-t.errc
-}
+		case "/addidentity", "/revokeidentity", "/removeidentity":
 
-func (t *Server) startServer() {
+			response := &ClientIdentityResponse{}
 
-	if logger.Trace {
-		zap.L().Debug("func (t *Server) startServer()")
-	}
+			if errMessage := requirePost(); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
+			token, errMessage := authorize(true)
+			if errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-	if t.embargo {
-		if logger.Trace {
-			zap.L().Debug("Embargo is in place")
-		}
-		return
-	}
+			nameParam := r.URL.Query().Get("name")
+			if nameParam == "" {
+				response.Error = "name is required"
+				zap.L().Debug("name missing from request")
+				return response
+			}
 
-	if logger.Trace {
-		zap.L().Debug("Embargo is NOT in place")
-	}
+			var identity *ClientIdentity
+			var err error
 
-	if t.cancel != nil {
-		if logger.Trace {
-			zap.L().Debug("Server is already running")
-		}
-		return
-	}
+			switch r.URL.Path {
 
-	ctx, cancel := context.WithCancel(context.Background())
-	t.cancel = cancel
+			case "/addidentity":
 
-	baseDir := filepath.Join(t.cacheDir, t.primaryDomain)
-	httpServer := &http.Server{
-		Addr:    ":443",
-		Handler: t,
-	}
+				var expires time.Time
+				if expiresParam := r.URL.Query().Get("expires"); expiresParam != "" {
+					expires, err = time.Parse(time.RFC3339, expiresParam)
+					if err != nil {
+						response.Error = fmt.Sprintf("expires %s is not an RFC 3339 time", expiresParam)
+						zap.L().Debug(response.Error)
+						return response
+					}
+				}
 
-	sendErr := func(err error) {
-		if err != nil {
-			if err == http.ErrServerClosed {
-				return
-			}
-			t.errc <- err
-		}
-	}
+				admin := r.URL.Query().Get("admin") == "true"
 
-	go func() {
-		zap.L().Debug("Starting ListenAndServeTLS : blocking")
-		err := httpServer.ListenAndServeTLS(filepath.Join(baseDir, CertPemFileName), filepath.Join(baseDir, KeyPemFileName))
-		zap.L().Debug("Stopping ListenAndServeTLS : not blocking")
-		sendErr(err)
-		cancel()
-	}()
+				identity, response.Secret, err = t.identities.addIdentity(nameParam, r.URL.Query()["domain"], admin, expires, r.URL.Query().Get("subject"), r.URL.Query().Get("spki"))
 
-	go func() {
+			case "/revokeidentity":
+				identity, err = t.identities.revokeIdentity(nameParam)
 
-		if logger.Trace {
-			zap.L().Debug("blocking start")
-		}
+			case "/removeidentity":
+				identity, err = t.identities.removeIdentity(nameParam)
 
-		<-ctx.Done()
+			}
 
-		if logger.Trace {
-			zap.L().Debug("blocking end")
-		}
+			if err != nil {
+				response.Error = err.Error()
+				zap.L().Error(fmt.Sprintf("Identity request %s by %s had error %s", r.URL.Path, token.getName(), err.Error()))
+				return response
+			}
 
-		zap.L().Debug("Shutting down ListenAndServeTLS")
-		ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancelShutdown()
-		sendErr(httpServer.Shutdown(ctxShutdown))
-		zap.L().Debug("ListenAndServeTLS shut down")
-	}()
+			zap.L().Info(fmt.Sprintf("Identity request %s for %s by %s", r.URL.Path, nameParam, token.getName()))
 
-}
+			response.Identity = identity
 
-func (t *Server) stopServer() {
+			return response
 
-	if logger.Trace {
-		zap.L().Debug("stopServer()")
-	}
+		case "/addenrollment":
 
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
+			response := &EnrollmentResponse{}
 
-	if t.cancel == nil {
-		zap.L().Debug("Server is not running")
-		return
-	}
+			if errMessage := requirePost(); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-	t.cancel()
-	t.cancel = nil
-}
+			token, errMessage := authorize(true)
+			if errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
 
-func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+			var life time.Duration
+			if lifeParam := r.URL.Query().Get("life"); lifeParam != "" {
+				var err error
+				life, err = time.ParseDuration(lifeParam)
+				if err != nil {
+					response.Error = fmt.Sprintf("life %s is not a duration", lifeParam)
+					zap.L().Debug(response.Error)
+					return response
+				}
+			}
 
-	serveHTTP := func() any {
+			enrollment, enrollmentToken, err := t.identities.addEnrollment(r.URL.Query().Get("name"), r.URL.Query()["domain"], life)
+			if err != nil {
+				response.Error = err.Error()
+				zap.L().Error(fmt.Sprintf("Enrollment request by %s had error %s", token.getName(), err.Error()))
+				return response
+			}
 
-		zap.L().Debug(fmt.Sprintf("Handling %s:%s", r.Method, r.URL.Path))
+			response.Enrollment = enrollment
+			response.Token = enrollmentToken
 
-		switch r.URL.Path {
+			return response
 
-		case "/getauthrequest":
-			return t.hashserver.NewRequest()
+		case "/enroll":
 
-		case "/getauthtoken":
+			response := &ClientIdentityResponse{}
 
-			response := &TokenResponse{}
+			if errMessage := requirePost(); errMessage != "" {
+				response.Error = errMessage
+				return response
+			}
+
+			if err := t.guard.check(guardKindAddress, remoteIP, t.guard.limits.Requests); err != nil {
+				response.Error = err.Error()
+				return response
+			}
 
 			postBytes, err := io.ReadAll(r.Body)
 			if err != nil {
@@ -409,35 +1819,38 @@ func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			defer r.Body.Close()
 
-			authRequest := &AuthRequest{}
-			err = json.Unmarshal(postBytes, authRequest)
-
+			enrollRequest := &EnrollRequest{}
+			err = json.Unmarshal(postBytes, enrollRequest)
 			if err != nil {
 				response.Error = err.Error()
-				zap.L().Error(err.Error())
+				zap.L().Debug(err.Error())
 				return response
 			}
 
-			token, err := t.hashserver.GetTokenFromRequest(authRequest)
+			identity, secret, err := t.identities.enroll(enrollRequest.Token, enrollRequest.Name)
 			if err != nil {
+				t.guard.fail(guardKindAddress, remoteIP)
 				response.Error = err.Error()
-				if logger.Trace {
-					zap.L().Debug(err.Error())
-				}
+				zap.L().Info(fmt.Sprintf("Enrollment from %s was refused; %s", r.RemoteAddr, err.Error()))
 				return response
 			}
 
-			return token
+			t.guard.succeed(guardKindAddress, remoteIP)
+
+			zap.L().Info(fmt.Sprintf("Identity %s enrolled from %s", identity.Name, r.RemoteAddr))
+
+			response.Identity = identity
+			response.Secret = secret
+
+			return response
 
 		case "/getcert":
 
 			response := &CertResponse{}
 
-			authHeader := r.Header.Get("Authorization")
-			bearerToken := strings.TrimPrefix(authHeader, PrefixBearer)
-			if bearerToken == "" {
-				response.Error = "bearerToken not found"
-				zap.L().Debug("bearerToken not found")
+			token, errMessage := authorize(false)
+			if errMessage != "" {
+				response.Error = errMessage
 				return response
 			}
 
@@ -451,26 +1864,72 @@ func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return response
 			}
 
-			domain := t.domains[domainParam]
+			domain := t.findDomain(domainParam)
 			if domain == nil {
 				response.Error = "domain not found"
 				zap.L().Debug("domain not found")
 				return response
 			}
 
-			err := t.hashserver.ValidateToken(bearerToken)
-			if err != nil {
-				response.Error = err.Error()
-				if logger.Trace {
-					zap.L().Debug(err.Error())
-				}
+			keyAlgorithmParam := r.URL.Query().Get("keyAlgorithm")
+			keyAlgorithm := types.KeyAlgorithmFromString(keyAlgorithmParam)
+
+			if keyAlgorithm == types.KeyAlgorithmUnknown {
+				response.Error = fmt.Sprintf("keyAlgorithm %s is not supported", keyAlgorithmParam)
+				zap.L().Debug(response.Error)
+				return response
+			}
+
+			domain = domain.getForKeyAlgorithm(keyAlgorithm)
+			if domain == nil {
+				response.Error = fmt.Sprintf("domain %s does not have a %s certificate", domainParam, string(keyAlgorithm))
+				zap.L().Debug(response.Error)
+				return response
+			}
+
+			// A token issued for one domain secret or identity is not valid for another domain
+			if !token.isValidFor(domain.Name) {
+				response.Error = fmt.Sprintf("token is not valid for domain %s", domainParam)
+				zap.L().Info(fmt.Sprintf("%s from %s was refused domain %s; token is not valid for the domain", token.getName(), r.RemoteAddr, domainParam))
 				return response
 			}
 
+			response.Identity = token.identity
+
 			cr, err := domain.get()
 
+			if chainParam := r.URL.Query().Get("chain"); chainParam != "" && cr != nil {
+				chainCR, chainErr := domain.getChain(chainParam)
+				if chainErr != nil {
+					response.Error = chainErr.Error()
+					zap.L().Debug(response.Error)
+					return response
+				}
+				cr = chainCR
+			}
+
 			if cr != nil {
 				response.CR = cr
+				response.KeyType = cr.GetKeyType()
+				if x509Cert, err := parseCertificate(cr); err == nil {
+					response.NotBefore = x509Cert.NotBefore
+					response.NotAfter = x509Cert.NotAfter
+					response.Stale = domain.isStale(x509Cert)
+					serial := types.GetSerial(x509Cert)
+					zap.L().Info(fmt.Sprintf("%s from %s fetched domain %s %s certificate %s", token.getName(), r.RemoteAddr, domain.Name, string(response.KeyType), serial))
+					if token.identity != "" {
+						t.identities.recordFetch(token.identity, &CertFetch{
+							Domain:     domain.Name,
+							KeyType:    response.KeyType,
+							Serial:     serial,
+							RemoteAddr: r.RemoteAddr,
+							Time:       time.Now(),
+						})
+					}
+				}
+				response.Chain = types.GetChainName(cr.IssuerCertificate)
+				response.Chains = domain.getAvailableChains()
+				response.OCSP, response.OCSPNextUpdate = domain.getOCSP()
 				if logger.Trace {
 					zap.L().Debug(fmt.Sprintf("domain %s has non nil CR", domain.Name))
 				}
@@ -478,9 +1937,29 @@ func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				zap.L().Debug(fmt.Sprintf("domain %s has nil CR", domain.Name))
 			}
 
-			if err != nil {
+			// The cached certificate is still returned when the ACME server can not
+			// be reached; the response is flagged as degraded instead of failing
+			var rateLimitErr *RateLimitError
+			if errors.As(err, &rateLimitErr) {
+				response.RetryAfter = rateLimitErr.RetryAt
+			}
+
+			if err != nil && cr != nil {
+				response.Degraded = true
+				response.DegradedReason = err.Error()
+				zap.L().Debug(fmt.Sprintf("domain %s is degraded; error %s", domain.Name, err.Error()))
+			} else if err != nil {
 				response.Error = err.Error()
 				zap.L().Debug(fmt.Sprintf("domain %s has error %s", domain.Name, err.Error()))
+			} else if cr == nil {
+				response.Error = fmt.Sprintf("domain %s does not have a certificate yet", domain.Name)
+			}
+
+			if response.Stale {
+				response.Degraded = true
+				if response.DegradedReason == "" {
+					response.DegradedReason = "certificate was not renewed within its renewal window"
+				}
 			}
 
 			return response
@@ -489,7 +1968,23 @@ func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		message := "Valid calls are\n"
 		message += fmt.Sprintf("GET https:/%s/getauthrequest\n", r.Host)
 		message += fmt.Sprintf("POST https:/%s/getauthtoken\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/getauthtoken?identity=pi\n", r.Host)
 		message += fmt.Sprintf("GET https:/%s/getcert?domain=example.com\n", r.Host)
+		message += fmt.Sprintf("GET https:/%s/getcert?domain=example.com&keyAlgorithm=ecdsa\n", r.Host)
+		message += fmt.Sprintf("GET https:/%s/getcert?domain=example.com&chain=ISRG+Root+X1\n", r.Host)
+		message += fmt.Sprintf("GET https:/%s/getstatus\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/revoke?domain=example.com&reason=keyCompromise\n", r.Host)
+		message += fmt.Sprintf("GET https:/%s/getaccounts\n", r.Host)
+		message += fmt.Sprintf("GET https:/%s/getratelimits\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/rotateaccountkey?domain=example.com\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/updateaccount?domain=example.com&email=admin@example.com\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/deactivateaccount?domain=example.com\n", r.Host)
+		message += fmt.Sprintf("GET https:/%s/getidentities\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/addidentity?name=pi&domain=example.com&expires=2030-01-01T00:00:00Z\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/revokeidentity?name=pi\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/removeidentity?name=pi\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/addenrollment?domain=example.com&life=1h\n", r.Host)
+		message += fmt.Sprintf("POST https:/%s/enroll\n", r.Host)
 
 		return &SimpleMessage{
 			Message: "see error",
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/home-simplecert/types"
+)
+
+func TestVariantInitError(t *testing.T) {
+
+	ca := newTestCA(t)
+
+	s := &Server{
+		cacheDir:     t.TempDir(),
+		jitter:       time.Hour,
+		ocspInterval: DefaultOCSPInterval,
+	}
+
+	domain := &DomainWrapper{
+		Domain:  &Domain{Name: "example.com", Dual: true},
+		Server:  s,
+		keyType: types.KeyTypeEC256,
+		reissue: make(chan struct{}, 1),
+	}
+
+	domain.variant = &DomainWrapper{
+		Domain:  domain.Domain,
+		Server:  s,
+		keyType: types.KeyTypeRSA2048,
+		certDir: filepath.Join(domain.getCacheDir(), string(types.KeyTypeRSA2048.GetKeyAlgorithm())),
+		reissue: make(chan struct{}, 1),
+	}
+
+	err := os.MkdirAll(domain.getCertDir(), CacheDirPerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = domain.saveCR(ca.issue(t, 100, false, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file in place of the variant certificate directory fails its init
+	err = os.WriteFile(domain.variant.getCertDir(), nil, CacheDirPerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = domain.init(ctx)
+
+	s.wg.Wait()
+
+	if err == nil {
+		t.Fatal("expected the variant error to be returned")
+	}
+
+	if cr, _ := domain.get(); cr == nil {
+		t.Fatal("expected the cached certificate to be loaded")
+	}
+
+	if _, err := domain.variant.get(); err == nil {
+		t.Fatal("expected the variant error to be set")
+	}
+}
+
+func TestDegradedStartup(t *testing.T) {
+
+	// The ACME server of the unreachable domain is closed before it is used
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	config := &Config{
+		Email:           "nobody@example.com",
+		CacheDir:        t.TempDir(),
+		Secret:          "secret",
+		DirectoryURL:    unreachable.URL + "/dir",
+		ListenAddress:   getFreeAddress(t),
+		DegradedStartup: true,
+	}
+
+	config.PrimaryDomain = &Domain{Name: "example.com"}
+
+	config.AddDomain(&Domain{Name: "unreachable.com"})
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the primary domain has a cached certificate
+	cr := newTestCA(t).issue(t, 100, false, false)
+
+	primaryDomain := s.domains["example.com"]
+
+	err = os.MkdirAll(primaryDomain.getCertDir(), CacheDirPerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = primaryDomain.saveCR(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Run(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("expected the server to stop without an error, got %s", err)
+		}
+	}()
+
+	// The cached certificate is loaded and the unreachable domain fails in the background
+	domain := s.domains["unreachable.com"]
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+
+		if _, err := domain.get(); err != nil && primaryDomain.isReady() {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the cached certificate to be loaded and the unreachable domain to have an error")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	token, err := getTestToken(s.auth, "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	getCert := func(name string) *CertResponse {
+
+		req, err := http.NewRequest(http.MethodGet, "https://"+config.ListenAddress+"/getcert?domain="+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", PrefixBearer+token.Token.Token)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+
+		response := &CertResponse{}
+
+		err = json.NewDecoder(resp.Body).Decode(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The API is served with the cached primary domain certificate
+		if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 100 {
+			t.Fatalf("expected the API to serve the cached certificate, got serial %s", resp.TLS.PeerCertificates[0].SerialNumber)
+		}
+
+		return response
+	}
+
+	// The domain with a cached certificate is served
+	response := getCert("example.com")
+
+	if response.Error != "" || response.CR == nil {
+		t.Fatalf("expected the cached certificate to be served, got error %s", response.Error)
+	}
+
+	if string(response.CR.Certificate) != string(cr.Certificate) {
+		t.Fatal("expected the cached certificate")
+	}
+
+	// The unreachable domain reports its error
+	response = getCert("unreachable.com")
+
+	if response.Error == "" || response.CR != nil {
+		t.Fatal("expected the unreachable domain to report an error without a certificate")
+	}
+
+	if domain.isReady() {
+		t.Fatal("expected the unreachable domain to not be ready")
+	}
+}
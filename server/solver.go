@@ -0,0 +1,228 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	logger "github.com/jodydadescott/jody-go-logger"
+	"go.uber.org/zap"
+)
+
+// solver answers the http-01 and tls-alpn-01 challenges for every domain. A
+// listener is started on an address when the first challenge using it is
+// presented and stopped when the last one is cleaned up, so domains renewing
+// at the same time share the listener instead of competing for the address.
+// The tls-alpn-01 challenge on the API address is answered by the API listener
+// itself so it is never stopped.
+type solver struct {
+	mutex      sync.Mutex
+	apiAddress string
+	httpTokens map[string]string
+	tlsCerts   map[string]*tls.Certificate
+	listeners  map[string]*solverListener
+}
+
+type solverListener struct {
+	server *http.Server
+	count  int
+}
+
+func newSolver(apiAddress string) *solver {
+	return &solver{
+		apiAddress: apiAddress,
+		httpTokens: make(map[string]string),
+		tlsCerts:   make(map[string]*tls.Certificate),
+		listeners:  make(map[string]*solverListener),
+	}
+}
+
+// acquire starts the listener on the address if it is not already running
+func (t *solver) acquire(address string, tlsListener bool) error {
+
+	listener := t.listeners[address]
+	if listener != nil {
+		listener.count++
+		return nil
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for challenges; %w", address, err)
+	}
+
+	server := &http.Server{Handler: t}
+
+	if tlsListener {
+		l = tls.NewListener(l, &tls.Config{
+			GetCertificate: t.getTLSCertificate,
+			NextProtos:     []string{tlsalpn01.ACMETLS1Protocol},
+		})
+	}
+
+	go func() {
+		err := server.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			zap.L().Error(fmt.Sprintf("Challenge listener %s had error %s", address, err.Error()))
+		}
+	}()
+
+	zap.L().Debug(fmt.Sprintf("Started challenge listener %s", address))
+
+	t.listeners[address] = &solverListener{server: server, count: 1}
+
+	return nil
+}
+
+// release stops the listener on the address if it is no longer used
+func (t *solver) release(address string) {
+
+	listener := t.listeners[address]
+	if listener == nil {
+		return
+	}
+
+	listener.count--
+	if listener.count > 0 {
+		return
+	}
+
+	delete(t.listeners, address)
+	listener.server.Close()
+
+	zap.L().Debug(fmt.Sprintf("Stopped challenge listener %s", address))
+}
+
+// ServeHTTP answers the http-01 challenge for any presented token
+func (t *solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	t.mutex.Lock()
+	keyAuth, ok := t.httpTokens[r.URL.Path]
+	t.mutex.Unlock()
+
+	if !ok {
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("No challenge for %s %s", r.Host, r.URL.Path))
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	zap.L().Debug(fmt.Sprintf("Served http-01 challenge for %s", r.Host))
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
+
+// getTLSCertificate returns the tls-alpn-01 challenge certificate for the server name
+func (t *solver) getTLSCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cert := t.tlsCerts[strings.ToLower(hello.ServerName)]
+	if cert == nil {
+		return nil, fmt.Errorf("no tls-alpn-01 challenge for %s", hello.ServerName)
+	}
+
+	zap.L().Debug(fmt.Sprintf("Served tls-alpn-01 challenge for %s", hello.ServerName))
+
+	return cert, nil
+}
+
+// isTLSALPNChallenge returns true if the client only accepts the tls-alpn-01 protocol
+func isTLSALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == tlsalpn01.ACMETLS1Protocol
+}
+
+// httpProvider returns a lego challenge provider for http-01 on the address
+func (t *solver) httpProvider(address string) *solverHTTPProvider {
+	return &solverHTTPProvider{solver: t, address: address}
+}
+
+// tlsProvider returns a lego challenge provider for tls-alpn-01 on the address
+func (t *solver) tlsProvider(address string) *solverTLSProvider {
+	return &solverTLSProvider{solver: t, address: address}
+}
+
+type solverHTTPProvider struct {
+	solver  *solver
+	address string
+}
+
+func (t *solverHTTPProvider) Present(domain, token, keyAuth string) error {
+
+	t.solver.mutex.Lock()
+	defer t.solver.mutex.Unlock()
+
+	err := t.solver.acquire(t.address, false)
+	if err != nil {
+		return err
+	}
+
+	t.solver.httpTokens[http01.ChallengePath(token)] = keyAuth
+
+	return nil
+}
+
+func (t *solverHTTPProvider) CleanUp(domain, token, keyAuth string) error {
+
+	t.solver.mutex.Lock()
+	defer t.solver.mutex.Unlock()
+
+	delete(t.solver.httpTokens, http01.ChallengePath(token))
+	t.solver.release(t.address)
+
+	return nil
+}
+
+type solverTLSProvider struct {
+	solver  *solver
+	address string
+}
+
+// sharesAPI returns true if the challenge is answered by the API listener
+func (t *solverTLSProvider) sharesAPI() bool {
+	return addressesConflict(t.address, t.solver.apiAddress)
+}
+
+func (t *solverTLSProvider) Present(domain, token, keyAuth string) error {
+
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+
+	t.solver.mutex.Lock()
+	defer t.solver.mutex.Unlock()
+
+	if !t.sharesAPI() {
+		err = t.solver.acquire(t.address, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.solver.tlsCerts[strings.ToLower(domain)] = cert
+
+	return nil
+}
+
+func (t *solverTLSProvider) CleanUp(domain, token, keyAuth string) error {
+
+	t.solver.mutex.Lock()
+	defer t.solver.mutex.Unlock()
+
+	delete(t.solver.tlsCerts, strings.ToLower(domain))
+
+	if !t.sharesAPI() {
+		t.solver.release(t.address)
+	}
+
+	return nil
+}
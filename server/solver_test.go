@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+// getFreeAddress returns a local address that is not listened on
+func getFreeAddress(t *testing.T) string {
+
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := l.Addr().String()
+	l.Close()
+
+	return address
+}
+
+// getChallenge returns the http-01 response for the token and the status code.
+// The status code is zero if the address is not listened on
+func getChallenge(t *testing.T, address string, token string) (string, int) {
+
+	t.Helper()
+
+	resp, err := http.Get("http://" + address + http01.ChallengePath(token))
+	if err != nil {
+		return "", 0
+	}
+
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b), resp.StatusCode
+}
+
+func TestSolverSharedListener(t *testing.T) {
+
+	address := getFreeAddress(t)
+
+	s := newSolver(getFreeAddress(t))
+
+	provider1 := s.httpProvider(address)
+	provider2 := s.httpProvider(address)
+
+	err := provider1.Present("a.com", "token1", "keyAuth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second domain shares the listener instead of failing to bind the address
+	err = provider2.Present("b.com", "token2", "keyAuth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer provider2.CleanUp("b.com", "token2", "keyAuth2")
+
+	if body, status := getChallenge(t, address, "token1"); status != http.StatusOK || body != "keyAuth1" {
+		t.Fatalf("expected keyAuth1, got status %d %s", status, body)
+	}
+
+	err = provider1.CleanUp("a.com", "token1", "keyAuth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener is still serving the other domain after the first is cleaned up
+	if body, status := getChallenge(t, address, "token2"); status != http.StatusOK || body != "keyAuth2" {
+		t.Fatalf("expected keyAuth2 after the first release, got status %d %s", status, body)
+	}
+
+	if _, status := getChallenge(t, address, "token1"); status != http.StatusNotFound {
+		t.Fatalf("expected a cleaned up token to not be found, got status %d", status)
+	}
+
+	err = provider2.CleanUp("b.com", "token2", "keyAuth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener is stopped with the last release
+	if _, status := getChallenge(t, address, "token2"); status != 0 {
+		t.Fatalf("expected the listener to be stopped, got status %d", status)
+	}
+
+	if len(s.listeners) != 0 {
+		t.Fatalf("expected no listeners, got %d", len(s.listeners))
+	}
+
+	// The address can be listened on again by the next challenge
+	err = provider1.Present("a.com", "token3", "keyAuth3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer provider1.CleanUp("a.com", "token3", "keyAuth3")
+
+	if body, status := getChallenge(t, address, "token3"); status != http.StatusOK || body != "keyAuth3" {
+		t.Fatalf("expected keyAuth3 after the listener restarted, got status %d %s", status, body)
+	}
+}
+
+func TestSolverTLSListener(t *testing.T) {
+
+	apiAddress := getFreeAddress(t)
+	address := getFreeAddress(t)
+
+	s := newSolver(apiAddress)
+
+	// The challenge on the API address is answered by the API listener
+	err := s.tlsProvider(apiAddress).Present("a.com", "token1", "keyAuth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.listeners) != 0 {
+		t.Fatal("expected no listener on the API address")
+	}
+
+	err = s.tlsProvider(address).Present("b.com", "token2", "keyAuth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.tlsProvider(address).CleanUp("b.com", "token2", "keyAuth2")
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		ServerName:         "b.com",
+		NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if conn.ConnectionState().NegotiatedProtocol != tlsalpn01.ACMETLS1Protocol {
+		t.Fatalf("expected protocol %s, got %s", tlsalpn01.ACMETLS1Protocol, conn.ConnectionState().NegotiatedProtocol)
+	}
+
+	if conn.ConnectionState().PeerCertificates[0].DNSNames[0] != "b.com" {
+		t.Fatalf("expected the challenge certificate for b.com, got %v", conn.ConnectionState().PeerCertificates[0].DNSNames)
+	}
+}
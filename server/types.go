@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/jinzhu/copier"
 	hashauthserver "github.com/jodydadescott/simple-go-hash-auth/server"
 
@@ -8,19 +10,62 @@ import (
 )
 
 type AuthRequest = hashauthserver.AuthRequest
+type Token = hashauthserver.Token
 type TokenResponse = types.TokenResponse
 type CertResponse = types.CertResponse
 type CR = types.CR
+type KeyType = types.KeyType
+type KeyAlgorithm = types.KeyAlgorithm
 type SimpleMessage = types.SimpleMessage
+type StatusResponse = types.StatusResponse
+type DomainStatus = types.DomainStatus
+type Chain = types.Chain
+type RevokeResponse = types.RevokeResponse
+type RevocationReason = types.RevocationReason
+type Account = types.Account
+type AccountsResponse = types.AccountsResponse
+type AccountResponse = types.AccountResponse
+type RateLimitStatus = types.RateLimitStatus
+type RateLimitsResponse = types.RateLimitsResponse
+type ClientIdentity = types.ClientIdentity
+type ClientIdentitiesResponse = types.ClientIdentitiesResponse
+type ClientIdentityResponse = types.ClientIdentityResponse
+type Enrollment = types.Enrollment
+type EnrollmentResponse = types.EnrollmentResponse
+type EnrollRequest = types.EnrollRequest
+type CertFetch = types.CertFetch
 type HTTPDebug = types.HTTPDebug
 
 type Config struct {
-	Notes         string    `json:"notes,omitempty" yaml:"notes,omitempty"`
-	PrimaryDomain *Domain   `json:"primaryDomain,omitempty" yaml:"primaryDomain,omitempty"`
-	Domains       []*Domain `json:"domains,omitempty" yaml:"domains,omitempty"`
-	Email         string    `json:"email,omitempty" yaml:"email,omitempty"`
-	CacheDir      string    `json:"cacheDir,omitempty" yaml:"cacheDir,omitempty"`
-	Secret        string    `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Notes                  string                  `json:"notes,omitempty" yaml:"notes,omitempty"`
+	PrimaryDomain          *Domain                 `json:"primaryDomain,omitempty" yaml:"primaryDomain,omitempty"`
+	Domains                []*Domain               `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Email                  string                  `json:"email,omitempty" yaml:"email,omitempty"`
+	CacheDir               string                  `json:"cacheDir,omitempty" yaml:"cacheDir,omitempty"`
+	Secret                 string                  `json:"secret,omitempty" yaml:"secret,omitempty"`
+	AdminSecret            string                  `json:"adminSecret,omitempty" yaml:"adminSecret,omitempty"`
+	DirectoryURL           string                  `json:"directoryUrl,omitempty" yaml:"directoryUrl,omitempty"`
+	CABundle               string                  `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	KeyType                string                  `json:"keyType,omitempty" yaml:"keyType,omitempty"`
+	Profile                string                  `json:"profile,omitempty" yaml:"profile,omitempty"`
+	RenewBefore            time.Duration           `json:"renewBefore,omitempty" yaml:"renewBefore,omitempty"`
+	RenewRatio             float64                 `json:"renewRatio,omitempty" yaml:"renewRatio,omitempty"`
+	CheckInterval          time.Duration           `json:"checkInterval,omitempty" yaml:"checkInterval,omitempty"`
+	Jitter                 time.Duration           `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	ListenAddress          string                  `json:"listenAddress,omitempty" yaml:"listenAddress,omitempty"`
+	HTTPChallengeAddress   string                  `json:"httpChallengeAddress,omitempty" yaml:"httpChallengeAddress,omitempty"`
+	TLSChallengeAddress    string                  `json:"tlsChallengeAddress,omitempty" yaml:"tlsChallengeAddress,omitempty"`
+	ExternalAccountBinding *ExternalAccountBinding `json:"externalAccountBinding,omitempty" yaml:"externalAccountBinding,omitempty"`
+	MustStaple             bool                    `json:"mustStaple,omitempty" yaml:"mustStaple,omitempty"`
+	OCSPResponder          string                  `json:"ocspResponder,omitempty" yaml:"ocspResponder,omitempty"`
+	OCSPInterval           time.Duration           `json:"ocspInterval,omitempty" yaml:"ocspInterval,omitempty"`
+	RetryInterval          time.Duration           `json:"retryInterval,omitempty" yaml:"retryInterval,omitempty"`
+	DegradedStartup        bool                    `json:"degradedStartup,omitempty" yaml:"degradedStartup,omitempty"`
+	InitWorkers            int                     `json:"initWorkers,omitempty" yaml:"initWorkers,omitempty"`
+	RateLimits             *RateLimits             `json:"rateLimits,omitempty" yaml:"rateLimits,omitempty"`
+	Identities             []*Identity             `json:"identities,omitempty" yaml:"identities,omitempty"`
+	ClientCA               string                  `json:"clientCa,omitempty" yaml:"clientCa,omitempty"`
+	AuthLimits             *AuthLimits             `json:"authLimits,omitempty" yaml:"authLimits,omitempty"`
 }
 
 // Clone return copy
@@ -36,8 +81,23 @@ func (t *Config) AddDomain(domains ...*Domain) *Config {
 }
 
 type Domain struct {
-	Name    string   `json:"name,omitempty" yaml:"name,omitempty"`
-	Aliases []string `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	Name                   string                  `json:"name,omitempty" yaml:"name,omitempty"`
+	Secret                 string                  `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Aliases                []string                `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	Challenge              *Challenge              `json:"challenge,omitempty" yaml:"challenge,omitempty"`
+	DirectoryURL           string                  `json:"directoryUrl,omitempty" yaml:"directoryUrl,omitempty"`
+	CABundle               string                  `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	KeyType                string                  `json:"keyType,omitempty" yaml:"keyType,omitempty"`
+	Dual                   bool                    `json:"dual,omitempty" yaml:"dual,omitempty"`
+	PreferredChain         string                  `json:"preferredChain,omitempty" yaml:"preferredChain,omitempty"`
+	Profile                string                  `json:"profile,omitempty" yaml:"profile,omitempty"`
+	RenewBefore            time.Duration           `json:"renewBefore,omitempty" yaml:"renewBefore,omitempty"`
+	RenewRatio             float64                 `json:"renewRatio,omitempty" yaml:"renewRatio,omitempty"`
+	CheckInterval          time.Duration           `json:"checkInterval,omitempty" yaml:"checkInterval,omitempty"`
+	Jitter                 time.Duration           `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	ExternalAccountBinding *ExternalAccountBinding `json:"externalAccountBinding,omitempty" yaml:"externalAccountBinding,omitempty"`
+	MustStaple             bool                    `json:"mustStaple,omitempty" yaml:"mustStaple,omitempty"`
+	OCSPResponder          string                  `json:"ocspResponder,omitempty" yaml:"ocspResponder,omitempty"`
 }
 
 func (t *Domain) AddAliases(aliases ...string) *Domain {
@@ -51,3 +111,128 @@ func (t *Domain) Clone() *Domain {
 	copier.Copy(&c, &t)
 	return c
 }
+
+// Challenge configures how ownership of a domain is proven to the ACME server. If
+// no challenge is set then http-01 on port 80 and tls-alpn-01 on port 443 are used.
+// For http-01 either Webroot, the document root of an existing web server, or
+// HTTPAddress, a local address for a listener the port 80 traffic is proxied to,
+// may be set; tls-alpn-01 is not used with either.
+// For dns-01 the Provider is the lego DNS provider name and Credentials maps the
+// provider environment variable names to values. A value may reference a file
+// (file:/path/to/secret) or another environment variable (env:NAME).
+type Challenge struct {
+	Type                    string            `json:"type,omitempty" yaml:"type,omitempty"`
+	Webroot                 string            `json:"webroot,omitempty" yaml:"webroot,omitempty"`
+	HTTPAddress             string            `json:"httpAddress,omitempty" yaml:"httpAddress,omitempty"`
+	Provider                string            `json:"provider,omitempty" yaml:"provider,omitempty"`
+	Credentials             map[string]string `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+	Resolvers               []string          `json:"resolvers,omitempty" yaml:"resolvers,omitempty"`
+	DisablePropagationCheck bool              `json:"disablePropagationCheck,omitempty" yaml:"disablePropagationCheck,omitempty"`
+}
+
+// Clone return copy
+func (t *Challenge) Clone() *Challenge {
+	c := &Challenge{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+func (t *Challenge) AddCredential(name, value string) *Challenge {
+	if t.Credentials == nil {
+		t.Credentials = make(map[string]string)
+	}
+	t.Credentials[name] = value
+	return t
+}
+
+// ExternalAccountBinding is the key ID and base64url encoded HMAC key issued by
+// an ACME CA that requires external account binding. The HMAC key may reference
+// a file (file:/path/to/key) or an environment variable (env:NAME).
+type ExternalAccountBinding struct {
+	KeyID   string `json:"keyId,omitempty" yaml:"keyId,omitempty"`
+	HMACKey string `json:"hmacKey,omitempty" yaml:"hmacKey,omitempty"`
+}
+
+// Clone return copy
+func (t *ExternalAccountBinding) Clone() *ExternalAccountBinding {
+	c := &ExternalAccountBinding{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// RateLimits are the CA issuance limits enforced from the ledger of issuance
+// attempts. CertificatesPerDomain counts certificates per registered domain,
+// DuplicateCertificates counts certificates for the exact same set of names and
+// FailedValidations counts failed attempts for the same set of names, each over
+// its window. The defaults are the Let's Encrypt limits. Disabled turns off the
+// checks but attempts are still recorded.
+type RateLimits struct {
+	CertificatesPerDomain       int           `json:"certificatesPerDomain,omitempty" yaml:"certificatesPerDomain,omitempty"`
+	CertificatesPerDomainWindow time.Duration `json:"certificatesPerDomainWindow,omitempty" yaml:"certificatesPerDomainWindow,omitempty"`
+	DuplicateCertificates       int           `json:"duplicateCertificates,omitempty" yaml:"duplicateCertificates,omitempty"`
+	DuplicateCertificatesWindow time.Duration `json:"duplicateCertificatesWindow,omitempty" yaml:"duplicateCertificatesWindow,omitempty"`
+	FailedValidations           int           `json:"failedValidations,omitempty" yaml:"failedValidations,omitempty"`
+	FailedValidationsWindow     time.Duration `json:"failedValidationsWindow,omitempty" yaml:"failedValidationsWindow,omitempty"`
+	Disabled                    bool          `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+}
+
+// Clone return copy
+func (t *RateLimits) Clone() *RateLimits {
+	c := &RateLimits{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// Identity is a named client with its own secret that may fetch the certificates
+// of Domains, which are domain names in the server config. The secret may
+// reference a file (file:/path/to/secret) or an environment variable (env:NAME).
+// A client may instead present a certificate to the API listener. It maps to the
+// identity if the base64 SHA-256 hash of its subject public key info equals
+// CertificateSPKI, or if it is verified by the server ClientCA and its subject
+// common name or distinguished name equals CertificateSubject. Admin allows the
+// identity to make the admin requests. An identity can not get a token after
+// Expires, if set, or once it is Revoked.
+type Identity struct {
+	Name               string    `json:"name,omitempty" yaml:"name,omitempty"`
+	Secret             string    `json:"secret,omitempty" yaml:"secret,omitempty"`
+	CertificateSubject string    `json:"certificateSubject,omitempty" yaml:"certificateSubject,omitempty"`
+	CertificateSPKI    string    `json:"certificateSpki,omitempty" yaml:"certificateSpki,omitempty"`
+	Domains            []string  `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Admin              bool      `json:"admin,omitempty" yaml:"admin,omitempty"`
+	Created            time.Time `json:"created,omitempty" yaml:"created,omitempty"`
+	Expires            time.Time `json:"expires,omitempty" yaml:"expires,omitempty"`
+	Revoked            bool      `json:"revoked,omitempty" yaml:"revoked,omitempty"`
+}
+
+// Clone return copy
+func (t *Identity) Clone() *Identity {
+	c := &Identity{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// AuthLimits protect the auth endpoints (/getauthrequest, /getauthtoken and
+// /enroll) from brute force. Each address may make Requests and each identity
+// IdentityRequests within Window. A failed token or enrollment request locks
+// out the address, and the identity it was for, for Lockout, doubling with
+// each consecutive failure up to MaxLockout. Allow and Deny are lists of CIDRs
+// (or addresses) for the whole API listener: if Allow is set only addresses in
+// it are served and an address in Deny is never served. Disabled turns off the
+// rate limits and lockouts but not Allow and Deny.
+type AuthLimits struct {
+	Requests         int           `json:"requests,omitempty" yaml:"requests,omitempty"`
+	IdentityRequests int           `json:"identityRequests,omitempty" yaml:"identityRequests,omitempty"`
+	Window           time.Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	Lockout          time.Duration `json:"lockout,omitempty" yaml:"lockout,omitempty"`
+	MaxLockout       time.Duration `json:"maxLockout,omitempty" yaml:"maxLockout,omitempty"`
+	Allow            []string      `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny             []string      `json:"deny,omitempty" yaml:"deny,omitempty"`
+	Disabled         bool          `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+}
+
+// Clone return copy
+func (t *AuthLimits) Clone() *AuthLimits {
+	c := &AuthLimits{}
+	copier.Copy(&c, &t)
+	return c
+}
@@ -2,6 +2,8 @@ package types
 
 import (
 	"os"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -12,3 +14,129 @@ const (
 
 	CodeVersion = "1.0.0"
 )
+
+type KeyType string
+
+const (
+	KeyTypeEmpty   KeyType = ""
+	KeyTypeRSA2048 KeyType = "rsa2048"
+	KeyTypeRSA4096 KeyType = "rsa4096"
+	KeyTypeRSA8192 KeyType = "rsa8192"
+	KeyTypeEC256   KeyType = "ec256"
+	KeyTypeEC384   KeyType = "ec384"
+	KeyTypeUnknown KeyType = "unknown"
+)
+
+func KeyTypeFromString(s string) KeyType {
+
+	switch strings.ToLower(s) {
+
+	case string(KeyTypeEmpty):
+		return KeyTypeEmpty
+
+	case string(KeyTypeRSA2048):
+		return KeyTypeRSA2048
+
+	case string(KeyTypeRSA4096):
+		return KeyTypeRSA4096
+
+	case string(KeyTypeRSA8192):
+		return KeyTypeRSA8192
+
+	case string(KeyTypeEC256):
+		return KeyTypeEC256
+
+	case string(KeyTypeEC384):
+		return KeyTypeEC384
+
+	}
+
+	return KeyTypeUnknown
+}
+
+// GetKeyAlgorithm returns the key algorithm of the key type
+func (t KeyType) GetKeyAlgorithm() KeyAlgorithm {
+
+	switch t {
+
+	case KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeRSA8192:
+		return KeyAlgorithmRSA
+
+	case KeyTypeEC256, KeyTypeEC384:
+		return KeyAlgorithmECDSA
+
+	}
+
+	return KeyAlgorithmUnknown
+}
+
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmEmpty   KeyAlgorithm = ""
+	KeyAlgorithmRSA     KeyAlgorithm = "rsa"
+	KeyAlgorithmECDSA   KeyAlgorithm = "ecdsa"
+	KeyAlgorithmUnknown KeyAlgorithm = "unknown"
+)
+
+func KeyAlgorithmFromString(s string) KeyAlgorithm {
+
+	switch strings.ToLower(s) {
+
+	case string(KeyAlgorithmEmpty):
+		return KeyAlgorithmEmpty
+
+	case string(KeyAlgorithmRSA):
+		return KeyAlgorithmRSA
+
+	case string(KeyAlgorithmECDSA):
+		return KeyAlgorithmECDSA
+
+	}
+
+	return KeyAlgorithmUnknown
+}
+
+// RevocationReason is the CRL reason code (RFC 5280) sent when a certificate is
+// revoked. Only the reasons accepted by ACME servers for a subscriber are supported
+type RevocationReason string
+
+const (
+	RevocationReasonEmpty                RevocationReason = ""
+	RevocationReasonUnspecified          RevocationReason = "unspecified"
+	RevocationReasonKeyCompromise        RevocationReason = "keyCompromise"
+	RevocationReasonAffiliationChanged   RevocationReason = "affiliationChanged"
+	RevocationReasonSuperseded           RevocationReason = "superseded"
+	RevocationReasonCessationOfOperation RevocationReason = "cessationOfOperation"
+	RevocationReasonUnknown              RevocationReason = "unknown"
+)
+
+var revocationReasonCodes = map[RevocationReason]uint{
+	RevocationReasonUnspecified:          0,
+	RevocationReasonKeyCompromise:        1,
+	RevocationReasonAffiliationChanged:   3,
+	RevocationReasonSuperseded:           4,
+	RevocationReasonCessationOfOperation: 5,
+}
+
+// RevocationReasonFromString returns the revocation reason for the name or the
+// reason code
+func RevocationReasonFromString(s string) RevocationReason {
+
+	if s == string(RevocationReasonEmpty) {
+		return RevocationReasonEmpty
+	}
+
+	for reason, code := range revocationReasonCodes {
+		if strings.EqualFold(s, string(reason)) || s == strconv.Itoa(int(code)) {
+			return reason
+		}
+	}
+
+	return RevocationReasonUnknown
+}
+
+// GetCode returns the reason code of the revocation reason
+func (t RevocationReason) GetCode() uint {
+	return revocationReasonCodes[t]
+}
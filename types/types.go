@@ -1,8 +1,18 @@
 package types
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"strings"
+	"time"
 
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/jinzhu/copier"
@@ -51,9 +61,76 @@ func (t *CR) GetKeyPEM() []byte {
 	return t.certResource.PrivateKey
 }
 
+// GetKeyType returns the key type of the certificate public key
+func (t *CR) GetKeyType() KeyType {
+
+	block, _ := pem.Decode(t.GetCertPEM())
+	if block == nil {
+		return KeyTypeUnknown
+	}
+
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return KeyTypeUnknown
+	}
+
+	return GetKeyType(x509Cert)
+}
+
+// GetSerial returns the certificate serial number as colon separated hex
+func GetSerial(x509Cert *x509.Certificate) string {
+
+	var serial []string
+	for _, b := range x509Cert.SerialNumber.Bytes() {
+		serial = append(serial, fmt.Sprintf("%02x", b))
+	}
+
+	return strings.Join(serial, ":")
+}
+
+// GetSPKIHash returns the base64 encoded SHA-256 hash of the certificate subject
+// public key info. This is the SPKI an identity is matched by
+func GetSPKIHash(x509Cert *x509.Certificate) string {
+	hash := sha256.Sum256(x509Cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// GetKeyType returns the key type of the certificate public key
+func GetKeyType(x509Cert *x509.Certificate) KeyType {
+
+	switch key := x509Cert.PublicKey.(type) {
+
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048
+		case 4096:
+			return KeyTypeRSA4096
+		case 8192:
+			return KeyTypeRSA8192
+		}
+
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return KeyTypeEC256
+		case elliptic.P384():
+			return KeyTypeEC384
+		}
+
+	}
+
+	return KeyTypeUnknown
+}
+
+// TokenResponse is the response to /getauthtoken. Identity is the name of the
+// client identity the token was issued to and Domains are the domains the token
+// is valid for
 type TokenResponse struct {
 	*hashserver.Token
-	Error string
+	Identity string
+	Domains  []string
+	Error    string
 }
 
 // Clone return copy
@@ -63,9 +140,67 @@ func (t *TokenResponse) Clone() *TokenResponse {
 	return c
 }
 
+// Chain is a certificate chain offered by the CA. Name is the common name of the
+// issuer of the top certificate in the chain
+type Chain struct {
+	Name              string `json:"name,omitempty" yaml:"name,omitempty"`
+	Certificate       []byte `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+	IssuerCertificate []byte `json:"issuerCertificate,omitempty" yaml:"issuerCertificate,omitempty"`
+}
+
+// GetChainName returns the common name of the issuer of the top certificate in
+// the PEM encoded issuer chain. This is the name matched by preferredChain
+func GetChainName(issuer []byte) string {
+
+	var name string
+
+	for {
+		var block *pem.Block
+		block, issuer = pem.Decode(issuer)
+		if block == nil {
+			break
+		}
+
+		x509Cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			break
+		}
+
+		name = x509Cert.Issuer.CommonName
+	}
+
+	return name
+}
+
+// CertResponse is the response to /getcert. OCSP is the DER encoded OCSP
+// response for the certificate. Degraded is true if the cached certificate is
+// returned while the ACME server can not be reached or the certificate is Stale,
+// meaning it has expired or was not renewed within its renewal window. RetryAfter
+// is set when issuance is deferred by a rate limit. Identity is the name of the
+// client identity the certificate was returned to.
 type CertResponse struct {
-	CR    *CR    `json:"cr,omitempty" yaml:"cr,omitempty"`
-	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+	CR             *CR       `json:"cr,omitempty" yaml:"cr,omitempty"`
+	KeyType        KeyType   `json:"keyType,omitempty" yaml:"keyType,omitempty"`
+	NotBefore      time.Time `json:"notBefore,omitempty" yaml:"notBefore,omitempty"`
+	NotAfter       time.Time `json:"notAfter,omitempty" yaml:"notAfter,omitempty"`
+	Chain          string    `json:"chain,omitempty" yaml:"chain,omitempty"`
+	Chains         []string  `json:"chains,omitempty" yaml:"chains,omitempty"`
+	OCSP           []byte    `json:"ocsp,omitempty" yaml:"ocsp,omitempty"`
+	OCSPNextUpdate time.Time `json:"ocspNextUpdate,omitempty" yaml:"ocspNextUpdate,omitempty"`
+	Degraded       bool      `json:"degraded,omitempty" yaml:"degraded,omitempty"`
+	DegradedReason string    `json:"degradedReason,omitempty" yaml:"degradedReason,omitempty"`
+	Stale          bool      `json:"stale,omitempty" yaml:"stale,omitempty"`
+	RetryAfter     time.Time `json:"retryAfter,omitempty" yaml:"retryAfter,omitempty"`
+	Identity       string    `json:"identity,omitempty" yaml:"identity,omitempty"`
+	Error          string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// GetLifetime returns the lifetime of the certificate or zero if it is not known
+func (t *CertResponse) GetLifetime() time.Duration {
+	if t.NotBefore.IsZero() || t.NotAfter.IsZero() {
+		return 0
+	}
+	return t.NotAfter.Sub(t.NotBefore)
 }
 
 // Clone return copy
@@ -87,6 +222,259 @@ func (t *SimpleMessage) Clone() *SimpleMessage {
 	return c
 }
 
+type DomainStatus struct {
+	Name                 string    `json:"name,omitempty" yaml:"name,omitempty"`
+	KeyType              KeyType   `json:"keyType,omitempty" yaml:"keyType,omitempty"`
+	NotAfter             time.Time `json:"notAfter,omitempty" yaml:"notAfter,omitempty"`
+	Serial               string    `json:"serial,omitempty" yaml:"serial,omitempty"`
+	Ready                bool      `json:"ready,omitempty" yaml:"ready,omitempty"`
+	Initialized          bool      `json:"initialized,omitempty" yaml:"initialized,omitempty"`
+	Degraded             bool      `json:"degraded,omitempty" yaml:"degraded,omitempty"`
+	Stale                bool      `json:"stale,omitempty" yaml:"stale,omitempty"`
+	NextCheck            time.Time `json:"nextCheck,omitempty" yaml:"nextCheck,omitempty"`
+	Profile              string    `json:"profile,omitempty" yaml:"profile,omitempty"`
+	OCSPStatus           string    `json:"ocspStatus,omitempty" yaml:"ocspStatus,omitempty"`
+	OCSPNextUpdate       time.Time `json:"ocspNextUpdate,omitempty" yaml:"ocspNextUpdate,omitempty"`
+	SuggestedWindowStart time.Time `json:"suggestedWindowStart,omitempty" yaml:"suggestedWindowStart,omitempty"`
+	SuggestedWindowEnd   time.Time `json:"suggestedWindowEnd,omitempty" yaml:"suggestedWindowEnd,omitempty"`
+	LastRenewal          time.Time `json:"lastRenewal,omitempty" yaml:"lastRenewal,omitempty"`
+	RenewalReason        string    `json:"renewalReason,omitempty" yaml:"renewalReason,omitempty"`
+	Error                string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *DomainStatus) Clone() *DomainStatus {
+	c := &DomainStatus{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+type StatusResponse struct {
+	Domains []*DomainStatus `json:"domains,omitempty" yaml:"domains,omitempty"`
+	// ServedSerial is the serial of the certificate served by the API listener
+	ServedSerial   string    `json:"servedSerial,omitempty" yaml:"servedSerial,omitempty"`
+	ServedNotAfter time.Time `json:"servedNotAfter,omitempty" yaml:"servedNotAfter,omitempty"`
+	Error          string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *StatusResponse) Clone() *StatusResponse {
+	c := &StatusResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// RevokeResponse is the response to /revoke. RevokedSerial is the serial of the
+// revoked certificate. The certificate is reissued in the background and
+// /getstatus reports the serial of the certificate issued to replace it
+type RevokeResponse struct {
+	Domain        string           `json:"domain,omitempty" yaml:"domain,omitempty"`
+	KeyType       KeyType          `json:"keyType,omitempty" yaml:"keyType,omitempty"`
+	Reason        RevocationReason `json:"reason,omitempty" yaml:"reason,omitempty"`
+	RevokedSerial string           `json:"revokedSerial,omitempty" yaml:"revokedSerial,omitempty"`
+	Error         string           `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *RevokeResponse) Clone() *RevokeResponse {
+	c := &RevokeResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// Account is an ACME account. Each domain has its own account kept in its cache
+// directory. KeyThumbprint is the RFC 7638 thumbprint of the account key
+type Account struct {
+	Domain               string   `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Email                string   `json:"email,omitempty" yaml:"email,omitempty"`
+	Contact              []string `json:"contact,omitempty" yaml:"contact,omitempty"`
+	URL                  string   `json:"url,omitempty" yaml:"url,omitempty"`
+	Status               string   `json:"status,omitempty" yaml:"status,omitempty"`
+	DirectoryURL         string   `json:"directoryUrl,omitempty" yaml:"directoryUrl,omitempty"`
+	ExternalAccountKeyID string   `json:"externalAccountKeyId,omitempty" yaml:"externalAccountKeyId,omitempty"`
+	KeyThumbprint        string   `json:"keyThumbprint,omitempty" yaml:"keyThumbprint,omitempty"`
+}
+
+// Clone return copy
+func (t *Account) Clone() *Account {
+	c := &Account{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+type AccountsResponse struct {
+	Accounts []*Account `json:"accounts,omitempty" yaml:"accounts,omitempty"`
+	Error    string     `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *AccountsResponse) Clone() *AccountsResponse {
+	c := &AccountsResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+type AccountResponse struct {
+	Account *Account `json:"account,omitempty" yaml:"account,omitempty"`
+	Error   string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *AccountResponse) Clone() *AccountResponse {
+	c := &AccountResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// RateLimitStatus is the headroom of a CA rate limit. Key is the registered
+// domain or the SAN set the limit is counted for. ResetAt is when the oldest
+// counted attempt leaves the window
+type RateLimitStatus struct {
+	Limit        string        `json:"limit,omitempty" yaml:"limit,omitempty"`
+	Key          string        `json:"key,omitempty" yaml:"key,omitempty"`
+	DirectoryURL string        `json:"directoryUrl,omitempty" yaml:"directoryUrl,omitempty"`
+	Count        int           `json:"count" yaml:"count"`
+	Max          int           `json:"max" yaml:"max"`
+	Remaining    int           `json:"remaining" yaml:"remaining"`
+	Window       time.Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	ResetAt      time.Time     `json:"resetAt,omitempty" yaml:"resetAt,omitempty"`
+}
+
+// Clone return copy
+func (t *RateLimitStatus) Clone() *RateLimitStatus {
+	c := &RateLimitStatus{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+type RateLimitsResponse struct {
+	Limits []*RateLimitStatus `json:"limits,omitempty" yaml:"limits,omitempty"`
+	Error  string             `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *RateLimitsResponse) Clone() *RateLimitsResponse {
+	c := &RateLimitsResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// ClientIdentity is a named client allowed to fetch the certificates of Domains.
+// Source is config for an identity from the server config and registry for an
+// identity added with /addidentity. CertificateSubject and CertificateSPKI map a
+// client certificate to the identity. Fetches are the last certificate fetched
+// for each domain since the server started
+type ClientIdentity struct {
+	Name               string       `json:"name,omitempty" yaml:"name,omitempty"`
+	Domains            []string     `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Admin              bool         `json:"admin,omitempty" yaml:"admin,omitempty"`
+	CertificateSubject string       `json:"certificateSubject,omitempty" yaml:"certificateSubject,omitempty"`
+	CertificateSPKI    string       `json:"certificateSpki,omitempty" yaml:"certificateSpki,omitempty"`
+	Source             string       `json:"source,omitempty" yaml:"source,omitempty"`
+	Created            time.Time    `json:"created,omitempty" yaml:"created,omitempty"`
+	Expires            time.Time    `json:"expires,omitempty" yaml:"expires,omitempty"`
+	Expired            bool         `json:"expired,omitempty" yaml:"expired,omitempty"`
+	Revoked            bool         `json:"revoked,omitempty" yaml:"revoked,omitempty"`
+	RevokedAt          time.Time    `json:"revokedAt,omitempty" yaml:"revokedAt,omitempty"`
+	Fetches            []*CertFetch `json:"fetches,omitempty" yaml:"fetches,omitempty"`
+}
+
+// Clone return copy
+func (t *ClientIdentity) Clone() *ClientIdentity {
+	c := &ClientIdentity{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// CertFetch is a certificate fetched by a client identity
+type CertFetch struct {
+	Domain     string    `json:"domain,omitempty" yaml:"domain,omitempty"`
+	KeyType    KeyType   `json:"keyType,omitempty" yaml:"keyType,omitempty"`
+	Serial     string    `json:"serial,omitempty" yaml:"serial,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty" yaml:"remoteAddr,omitempty"`
+	Time       time.Time `json:"time,omitempty" yaml:"time,omitempty"`
+}
+
+// Clone return copy
+func (t *CertFetch) Clone() *CertFetch {
+	c := &CertFetch{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+type ClientIdentitiesResponse struct {
+	Identities []*ClientIdentity `json:"identities,omitempty" yaml:"identities,omitempty"`
+	Error      string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *ClientIdentitiesResponse) Clone() *ClientIdentitiesResponse {
+	c := &ClientIdentitiesResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// ClientIdentityResponse is the response to the identity requests. Secret is
+// only set by /addidentity and is not returned again
+type ClientIdentityResponse struct {
+	Identity *ClientIdentity `json:"identity,omitempty" yaml:"identity,omitempty"`
+	Secret   string          `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Error    string          `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *ClientIdentityResponse) Clone() *ClientIdentityResponse {
+	c := &ClientIdentityResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// Enrollment is a single use enrollment token that a new client exchanges with
+// /enroll for a client identity for Domains. Name is the identity name; if it
+// is empty the client names the identity
+type Enrollment struct {
+	Name    string    `json:"name,omitempty" yaml:"name,omitempty"`
+	Domains []string  `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Created time.Time `json:"created,omitempty" yaml:"created,omitempty"`
+	Expires time.Time `json:"expires,omitempty" yaml:"expires,omitempty"`
+}
+
+// Clone return copy
+func (t *Enrollment) Clone() *Enrollment {
+	c := &Enrollment{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// EnrollmentResponse is the response to /addenrollment. Token is only returned
+// once
+type EnrollmentResponse struct {
+	Enrollment *Enrollment `json:"enrollment,omitempty" yaml:"enrollment,omitempty"`
+	Token      string      `json:"token,omitempty" yaml:"token,omitempty"`
+	Error      string      `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Clone return copy
+func (t *EnrollmentResponse) Clone() *EnrollmentResponse {
+	c := &EnrollmentResponse{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// EnrollRequest is the request body of /enroll. Name is the identity name used
+// if the enrollment does not have one
+type EnrollRequest struct {
+	Token string `json:"token,omitempty" yaml:"token,omitempty"`
+	Name  string `json:"name,omitempty" yaml:"name,omitempty"`
+}
+
+// Clone return copy
+func (t *EnrollRequest) Clone() *EnrollRequest {
+	c := &EnrollRequest{}
+	copier.Copy(&c, &t)
+	return c
+}
+
 type HTTPDebug struct {
 	Request  string `json:"request,omitempty" yaml:"request,omitempty"`
 	Response string `json:"response,omitempty" yaml:"response,omitempty"`